@@ -0,0 +1,176 @@
+package pdsql
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/miekg/dns"
+	"gorm.io/gorm"
+)
+
+// addressCheckPrefix starts the line of an A or AAAA RRset comment declaring its health check.
+const addressCheckPrefix = "health-check "
+
+// addressChecks omits the addresses of A and AAAA RRsets failing their health check from the answers.
+// The checks are declared in the PowerDNS comments table with a "health-check tcp:PORT" or
+// "health-check URL" line and reloaded every interval.
+type addressChecks struct {
+	db       *gorm.DB
+	checker  *targetChecker
+	interval time.Duration
+
+	mu     sync.RWMutex
+	checks map[staleKey]string
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newAddressChecks(db *gorm.DB, checker *targetChecker, interval time.Duration) *addressChecks {
+	return &addressChecks{db: db, checker: checker, interval: interval, checks: make(map[staleKey]string)}
+}
+
+// parseAddressCheck returns the check of a comment, "tcp:PORT" or an http or https URL.
+func parseAddressCheck(comment string) (string, error) {
+	for _, line := range strings.Split(comment, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, addressCheckPrefix) {
+			continue
+		}
+		check := strings.TrimSpace(strings.TrimPrefix(line, addressCheckPrefix))
+		if port, ok := strings.CutPrefix(check, "tcp:"); ok {
+			if i, err := strconv.Atoi(port); err != nil || i <= 0 || i > 65535 {
+				return "", fmt.Errorf("invalid port %q", port)
+			}
+			return check, nil
+		}
+		if u, err := url.Parse(check); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", fmt.Errorf("invalid check %q, expected tcp:PORT or an http URL", check)
+		}
+		return check, nil
+	}
+	return "", nil
+}
+
+// Load reads the checks of the A and AAAA RRsets from the comments table.
+func (c *addressChecks) Load(ctx context.Context) error {
+	var comments []pdnsmodel.Comment
+	if err := c.db.WithContext(ctx).Where(map[string]interface{}{"type": []string{"A", "AAAA"}}).Find(&comments).Error; err != nil {
+		return err
+	}
+
+	checks := make(map[staleKey]string)
+	for _, comment := range comments {
+		check, err := parseAddressCheck(comment.Comment)
+		if err != nil {
+			log.Warningf("ignore comment %d %s %s: %v", comment.ID, comment.Name, comment.Type, err)
+			continue
+		}
+		if check != "" {
+			checks[staleKey{qname: dns.Fqdn(normalizeName(comment.Name)), qtype: dns.StringToType[comment.Type]}] = check
+		}
+	}
+
+	c.mu.Lock()
+	c.checks = checks
+	c.mu.Unlock()
+	return nil
+}
+
+// probe returns the check key and probe of ip.
+func (c *addressChecks) probe(check, ip string) (string, func(ctx context.Context) error) {
+	if port, ok := strings.CutPrefix(check, "tcp:"); ok {
+		target := net.JoinHostPort(ip, port)
+		return "tcp " + target, probeTCP(target)
+	}
+	return fmt.Sprintf("url %s %s", check, ip), probeURL(check, ip)
+}
+
+// Filter drops the addresses of checked RRsets which are down, an RRset with all addresses
+// down is kept whole.
+func (c *addressChecks) Filter(answer []dns.RR) []dns.RR {
+	if c == nil {
+		return answer
+	}
+	c.mu.RLock()
+	checks := c.checks
+	c.mu.RUnlock()
+	if len(checks) == 0 {
+		return answer
+	}
+
+	down := map[dns.RR]bool{}
+	up := map[staleKey]bool{}
+	for _, rr := range answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		k := staleKey{qname: strings.ToLower(rr.Header().Name), qtype: rr.Header().Rrtype}
+		check, ok := checks[k]
+		if !ok {
+			continue
+		}
+		if c.checker.Up(c.probe(check, ip.String())) {
+			up[k] = true
+		} else {
+			down[rr] = true
+		}
+	}
+	if len(down) == 0 {
+		return answer
+	}
+
+	out := make([]dns.RR, 0, len(answer))
+	for _, rr := range answer {
+		k := staleKey{qname: strings.ToLower(rr.Header().Name), qtype: rr.Header().Rrtype}
+		if down[rr] && up[k] {
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+func (c *addressChecks) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			if err := c.Load(ctx); err != nil {
+				log.Warningf("load health checks failed error=%q", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *addressChecks) Stop() error {
+	if c.cancel != nil {
+		c.cancel()
+		<-c.done
+	}
+	return nil
+}
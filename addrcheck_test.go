@@ -0,0 +1,107 @@
+package pdsql
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+func TestParseAddressCheck(t *testing.T) {
+	tests := []struct {
+		comment  string
+		expected string
+		err      bool
+	}{
+		{"health-check tcp:443", "tcp:443", false},
+		{"web servers\nhealth-check https://www.example.org/health", "https://www.example.org/health", false},
+		{"just a comment", "", false},
+		{"health-check tcp:http", "", true},
+		{"health-check ftp://example.org", "", true},
+	}
+	for _, tc := range tests {
+		check, err := parseAddressCheck(tc.comment)
+		if (err != nil) != tc.err || check != tc.expected {
+			t.Errorf("%q: Expected %q err %v, but got %q err %v", tc.comment, tc.expected, tc.err, check, err)
+		}
+	}
+}
+
+func TestServeCheckedAddresses(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{DB: db, checker: newTargetChecker(time.Hour, time.Second)}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	p.checks = newAddressChecks(db, p.checker, time.Hour)
+	for _, r := range []pdnsmodel.Record{
+		{Name: "www.example.org", Type: "A", Content: "127.0.0.1", Ttl: 60},
+		{Name: "www.example.org", Type: "A", Content: "127.0.0.2", Ttl: 60},
+		{Name: "down.example.org", Type: "A", Content: "127.0.0.2", Ttl: 60},
+		{Name: "down.example.org", Type: "A", Content: "127.0.0.3", Ttl: 60},
+	} {
+		if err := db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []pdnsmodel.Comment{
+		{Name: "www.example.org", Type: "A", Comment: "health-check tcp:" + port},
+		{Name: "down.example.org", Type: "A", Comment: "health-check tcp:" + port},
+	} {
+		if err := db.Create(&c).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.checks.Load(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(name string) []string {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := p.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatalf("Expected no error for %s, but got %v", name, err)
+		}
+		var out []string
+		for _, rr := range rec.Msg.Answer {
+			out = append(out, rr.(*dns.A).A.String())
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	// not probed yet, all are up
+	if got := query("www.example.org."); len(got) != 2 {
+		t.Fatalf("Expected both addresses before the first probe, but got %v", got)
+	}
+	query("down.example.org.")
+	p.checker.CheckAll(context.TODO())
+
+	if got := query("www.example.org."); len(got) != 1 || got[0] != "127.0.0.1" {
+		t.Errorf("Expected only the healthy address, but got %v", got)
+	}
+	if got := query("down.example.org."); len(got) != 2 {
+		t.Errorf("Expected all addresses when all are down, but got %v", got)
+	}
+}
@@ -0,0 +1,180 @@
+package pdsql
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// TypeALIAS is the type PowerDNS uses for ALIAS records in zone transfers.
+const TypeALIAS uint16 = 65401
+
+// ErrAliasUpstream is returned when the target of an ALIAS record can not be resolved upstream.
+var ErrAliasUpstream = errors.New("pdsql: ALIAS target can not be resolved")
+
+const (
+	defaultAliasEntries = 10000
+	// aliasNegativeTTL is how long a target without addresses is cached.
+	aliasNegativeTTL = 30 * time.Second
+	aliasTimeout     = 2 * time.Second
+)
+
+// aliasResolver resolves the out of zone targets of ALIAS records through upstream servers,
+// caching the addresses for their TTL.
+type aliasResolver struct {
+	upstreams  []string
+	client     *dns.Client
+	mu         sync.RWMutex
+	entries    map[staleKey]aliasEntry
+	maxEntries int
+	now        func() time.Time
+}
+
+type aliasEntry struct {
+	answer  []dns.RR
+	expires time.Time
+}
+
+func newAliasResolver(upstreams []string) *aliasResolver {
+	return &aliasResolver{
+		upstreams:  upstreams,
+		client:     &dns.Client{Timeout: aliasTimeout},
+		entries:    make(map[staleKey]aliasEntry),
+		maxEntries: defaultAliasEntries,
+		now:        time.Now,
+	}
+}
+
+// Resolve returns the qtype records of target, asking the upstreams in order until one answers.
+func (a *aliasResolver) Resolve(ctx context.Context, target string, qtype uint16) ([]dns.RR, error) {
+	k := staleKey{qname: strings.ToLower(dns.Fqdn(target)), qtype: qtype}
+	a.mu.RLock()
+	e, ok := a.entries[k]
+	a.mu.RUnlock()
+	if ok && a.now().Before(e.expires) {
+		return e.answer, nil
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(k.qname, qtype)
+	for _, upstream := range a.upstreams {
+		r, _, err := a.client.ExchangeContext(ctx, m, upstream)
+		if err != nil {
+			log.Warningf("alias upstream=%s target=%s error=%q", upstream, k.qname, err)
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			continue
+		}
+		e := aliasEntry{expires: a.now().Add(aliasNegativeTTL)}
+		ttl := uint32(0)
+		for _, rr := range r.Answer {
+			if rr.Header().Rrtype != qtype {
+				continue
+			}
+			if len(e.answer) == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+			e.answer = append(e.answer, rr)
+		}
+		if len(e.answer) != 0 {
+			e.expires = a.now().Add(time.Duration(ttl) * time.Second)
+		}
+		a.store(k, e)
+		return e.answer, nil
+	}
+	return nil, ErrAliasUpstream
+}
+
+func (a *aliasResolver) store(k staleKey, e aliasEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.entries[k]; !ok && len(a.entries) >= a.maxEntries {
+		for dk := range a.entries {
+			delete(a.entries, dk)
+			break
+		}
+	}
+	a.entries[k] = e
+}
+
+// expandALIAS synthesizes the A or AAAA records of an ALIAS row with the owner name of the row. Targets
+// known to the database are resolved from the records table, other ones through the alias upstreams.
+func (pdb PowerDNSGenericSQLBackend) expandALIAS(ctx context.Context, v *pdnsmodel.Record, qtype uint16) ([]dns.RR, error) {
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return nil, nil
+	}
+
+	pdb.DB = pdb.DB.WithContext(ctx)
+	records, stats, err := pdb.lookup(v.Content, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	var answer []dns.RR
+	switch {
+	case len(records) != 0 || stats.domainID != 0:
+		for _, r := range records {
+			if r.Type != dns.TypeToString[qtype] {
+				continue
+			}
+			if rr, err := ToRR(r, dns.ClassINET); err == nil && rr != nil {
+				answer = append(answer, rr)
+			}
+		}
+	case pdb.alias != nil:
+		if answer, err = pdb.alias.Resolve(ctx, v.Content, qtype); err != nil {
+			return nil, err
+		}
+	default:
+		log.Warningf("alias target=%s of %s is not in the database and no alias-upstream is set", v.Content, v.Name)
+		return nil, nil
+	}
+
+	out := make([]dns.RR, 0, len(answer))
+	for _, rr := range answer {
+		rr = dns.Copy(rr)
+		hdr := rr.Header()
+		hdr.Name = dns.Fqdn(v.Name)
+		hdr.Class = dns.ClassINET
+		if hdr.Ttl > v.Ttl {
+			hdr.Ttl = v.Ttl
+		}
+		out = append(out, rr)
+	}
+	return out, nil
+}
+
+// aliasRR returns an ALIAS row as the TYPE65401 record PowerDNS uses in zone transfers.
+func aliasRR(v *pdnsmodel.Record, class uint16) (dns.RR, error) {
+	buf := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(v.Content), buf, 0, nil, false)
+	if err != nil {
+		return nil, malformed(v, "invalid ALIAS target: %s", v.Content)
+	}
+	return &dns.RFC3597{
+		Hdr:   dns.RR_Header{Name: dns.Fqdn(v.Name), Rrtype: TypeALIAS, Class: class, Ttl: v.Ttl},
+		Rdata: hex.EncodeToString(buf[:n]),
+	}, nil
+}
+
+// aliasTarget returns the target of a TYPE65401 record.
+func aliasTarget(rr *dns.RFC3597) (string, error) {
+	buf, err := hex.DecodeString(rr.Rdata)
+	if err != nil {
+		return "", err
+	}
+	target, _, err := dns.UnpackDomainName(buf, 0)
+	if err != nil {
+		return "", fmt.Errorf("invalid ALIAS rdata: %w", err)
+	}
+	return target, nil
+}
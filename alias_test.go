@@ -0,0 +1,105 @@
+package pdsql
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+func TestServeALIAS(t *testing.T) {
+	var upstreamQueries int32
+	upstream := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&upstreamQueries, 1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			m.Answer = []dns.RR{
+				test.CNAME("cdn.example.net. 300 IN CNAME edge.example.net."),
+				test.A("edge.example.net. 60 IN A 203.0.113.1"),
+			}
+		}
+		w.WriteMsg(m)
+	})
+	defer upstream.Close()
+
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{DB: db, Next: test.NextHandler(dns.RcodeNameError, nil), alias: newAliasResolver([]string{upstream.Addr})}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []pdnsmodel.Record{
+		{Name: "example.org", Type: "ALIAS", Content: "cdn.example.net", Ttl: 3600},
+		{Name: "www.example.org", Type: "ALIAS", Content: "web.example.org", Ttl: 30},
+		{Name: "web.example.org", Type: "A", Content: "192.168.1.1", Ttl: 3600},
+		{Name: "web.example.org", Type: "A", Content: "192.168.1.2", Ttl: 3600},
+	} {
+		if err := db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := func(name string, qtype uint16) (int, *dns.Msg) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		code, err := p.ServeDNS(context.TODO(), rec, req)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, but got %v", name, err)
+		}
+		return code, rec.Msg
+	}
+
+	_, msg := query("www.example.org.", dns.TypeA)
+	if len(msg.Answer) != 2 {
+		t.Fatalf("Expected the two A records of the in zone target, but got %v", msg.Answer)
+	}
+	for _, rr := range msg.Answer {
+		if rr.Header().Name != "www.example.org." || rr.Header().Rrtype != dns.TypeA || rr.Header().Ttl != 30 {
+			t.Errorf("Expected A records owned by www.example.org. with ttl 30, but got %v", rr)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		_, msg = query("example.org.", dns.TypeA)
+		if len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "203.0.113.1" || msg.Answer[0].Header().Name != "example.org." {
+			t.Fatalf("Expected the upstream A record owned by example.org., but got %v", msg.Answer)
+		}
+	}
+	if n := atomic.LoadInt32(&upstreamQueries); n != 1 {
+		t.Errorf("Expected the second answer from the cache, but upstream got %d queries", n)
+	}
+
+	if code, _ := query("example.org.", dns.TypeTXT); code != dns.RcodeNameError {
+		t.Errorf("Expected the ALIAS to answer A and AAAA only, but got code %d", code)
+	}
+}
+
+func TestALIASTransfer(t *testing.T) {
+	v := &pdnsmodel.Record{Name: "example.org", Type: "ALIAS", Content: "cdn.example.net", Ttl: 3600}
+	rr, err := ToRR(v, dns.ClassINET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Header().Rrtype != TypeALIAS {
+		t.Fatalf("Expected TYPE65401, but got %v", rr)
+	}
+
+	parsed, err := dns.NewRR(rr.String())
+	if err != nil {
+		t.Fatalf("Expected the exported record to parse, but got %v", err)
+	}
+	if r := FromRR(parsed); r.Type != "ALIAS" || r.Content != "cdn.example.net" || r.Name != "example.org" {
+		t.Errorf("Expected the ALIAS row back, but got %+v", r)
+	}
+}
@@ -0,0 +1,53 @@
+package pdsql
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// anyFull answers ANY queries with every record of the name, over TCP unless anyUDP is set.
+	anyFull = iota
+	// anyHINFO answers ANY queries with a synthesized HINFO record as in RFC 8482 section 4.2.
+	anyHINFO
+	// anyOneRRset answers ANY queries with a single RRset of the name.
+	anyOneRRset
+)
+
+// anyModes maps the any option to the way ANY queries are answered.
+var anyModes = map[string]int{
+	"full":      anyFull,
+	"hinfo":     anyHINFO,
+	"one-rrset": anyOneRRset,
+}
+
+// anyHINFOTTL is the TTL of the synthesized HINFO record, as used by the any plugin.
+const anyHINFOTTL = 8482
+
+// truncateANY reports whether an ANY query for a name with records must be answered with TC set
+// to move it to TCP, full answers over UDP make pdsql an amplification vector.
+func (pdb PowerDNSGenericSQLBackend) truncateANY(state request.Request) bool {
+	return state.QType() == dns.TypeANY && pdb.anyMode == anyFull && !pdb.anyUDP && state.Proto() == "udp"
+}
+
+// minimalANY reduces the answer of an ANY query according to the any option.
+func (pdb PowerDNSGenericSQLBackend) minimalANY(state request.Request, answer []dns.RR) []dns.RR {
+	if state.QType() != dns.TypeANY || len(answer) == 0 {
+		return answer
+	}
+	switch pdb.anyMode {
+	case anyHINFO:
+		hdr := dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: anyHINFOTTL}
+		return []dns.RR{&dns.HINFO{Hdr: hdr, Cpu: "RFC8482"}}
+	case anyOneRRset:
+		t := answer[0].Header().Rrtype
+		var rrset []dns.RR
+		for _, rr := range answer {
+			if rr.Header().Rrtype == t {
+				rrset = append(rrset, rr)
+			}
+		}
+		return rrset
+	}
+	return answer
+}
@@ -0,0 +1,80 @@
+package pdsql
+
+import (
+	"testing"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+func TestServeANY(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{DB: db, Next: test.NextHandler(dns.RcodeNameError, nil)}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []pdnsmodel.Record{
+		{Name: "example.org", Type: "A", Content: "192.168.1.1", Ttl: 3600},
+		{Name: "example.org", Type: "A", Content: "192.168.1.2", Ttl: 3600},
+		{Name: "example.org", Type: "TXT", Content: "text", Ttl: 3600},
+	} {
+		if err := db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := func(tcp bool) *dns.Msg {
+		_, msg := queryANY(t, p, "example.org.", tcp)
+		return msg
+	}
+	if msg := query(false); !msg.Truncated || len(msg.Answer) != 0 {
+		t.Errorf("Expected an empty truncated answer over UDP, but got %v", msg)
+	}
+	// names without records go to the next plugin without TC
+	if code, msg := queryANY(t, p, "other.example.net.", false); code != dns.RcodeNameError || msg != nil {
+		t.Errorf("Expected the query passed to the next plugin, but got code %d msg %v", code, msg)
+	}
+	if msg := query(true); msg.Truncated || len(msg.Answer) != 3 {
+		t.Errorf("Expected the full answer over TCP, but got %v", msg)
+	}
+
+	p.anyUDP = true
+	if msg := query(false); msg.Truncated || len(msg.Answer) != 3 {
+		t.Errorf("Expected the full answer over UDP, but got %v", msg)
+	}
+
+	p.anyMode = anyHINFO
+	msg := query(false)
+	if len(msg.Answer) != 1 {
+		t.Fatalf("Expected a single HINFO, but got %v", msg.Answer)
+	}
+	if hinfo, ok := msg.Answer[0].(*dns.HINFO); !ok || hinfo.Cpu != "RFC8482" || hinfo.Hdr.Name != "example.org." {
+		t.Errorf("Expected HINFO RFC8482, but got %v", msg.Answer[0])
+	}
+
+	p.anyMode = anyOneRRset
+	msg = query(false)
+	if len(msg.Answer) != 2 || msg.Answer[0].Header().Rrtype != dns.TypeA || msg.Answer[1].Header().Rrtype != dns.TypeA {
+		t.Errorf("Expected the A RRset only, but got %v", msg.Answer)
+	}
+}
+
+func queryANY(t *testing.T, p PowerDNSGenericSQLBackend, name string, tcp bool) (int, *dns.Msg) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeANY)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: tcp})
+	code, err := p.ServeDNS(context.TODO(), rec, req)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	return code, rec.Msg
+}
@@ -0,0 +1,489 @@
+package pdsql
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+	"gorm.io/gorm"
+)
+
+// apiVersion is reported to clients which gate features on the PowerDNS version.
+const apiVersion = "4.8.0"
+
+const apiPrefix = "/api/v1/servers/localhost"
+
+// apiServer implements the zone and rrset endpoints of the PowerDNS HTTP API on the pdsql database.
+type apiServer struct {
+	backend  PowerDNSGenericSQLBackend
+	addr     string
+	key      string
+	transfer *transfer.Transfer
+
+	ln  net.Listener
+	srv *http.Server
+	now func() time.Time
+}
+
+type apiZone struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Type        string     `json:"type"`
+	URL         string     `json:"url"`
+	Kind        string     `json:"kind"`
+	Serial      uint32     `json:"serial"`
+	Account     string     `json:"account"`
+	Masters     []string   `json:"masters"`
+	Nameservers []string   `json:"nameservers,omitempty"`
+	RRsets      []apiRRset `json:"rrsets,omitempty"`
+}
+
+type apiRRset struct {
+	Name       string        `json:"name"`
+	Type       string        `json:"type"`
+	TTL        uint32        `json:"ttl"`
+	Changetype string        `json:"changetype,omitempty"`
+	Records    []apiRecord   `json:"records"`
+	Comments   []interface{} `json:"comments"`
+}
+
+type apiRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+// apiError is returned by the handlers to reply with a PowerDNS style error.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+func apiErrorf(status int, format string, args ...interface{}) error {
+	return &apiError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+func newAPIServer(backend PowerDNSGenericSQLBackend, addr, key string) *apiServer {
+	return &apiServer{backend: backend, addr: addr, key: key, now: time.Now}
+}
+
+func (s *apiServer) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	s.ln, s.srv = ln, srv
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+			log.Errorf("api server failed addr=%s error=%q", s.addr, err)
+		}
+	}()
+	return nil
+}
+
+// Stop closes the listener, it is also called before a reload so the new instance can bind the address.
+func (s *apiServer) Stop() error {
+	if s.srv == nil {
+		return nil
+	}
+	ln, srv := s.ln, s.srv
+	s.ln, s.srv = nil, nil
+	// the listener is closed too in case Serve did not take it yet
+	ln.Close()
+	return srv.Close()
+}
+
+// Handler returns the http handler of the API.
+func (s *apiServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+apiPrefix, s.handle(s.getServer))
+	mux.HandleFunc("GET "+apiPrefix+"/zones", s.handle(s.listZones))
+	mux.HandleFunc("POST "+apiPrefix+"/zones", s.handle(s.createZone))
+	mux.HandleFunc("GET "+apiPrefix+"/zones/{zone}", s.handle(s.getZone))
+	mux.HandleFunc("PATCH "+apiPrefix+"/zones/{zone}", s.handle(s.patchZone))
+	mux.HandleFunc("DELETE "+apiPrefix+"/zones/{zone}", s.handle(s.deleteZone))
+	return mux
+}
+
+func (s *apiServer) handle(fn func(r *http.Request) (int, interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(s.key)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+			return
+		}
+
+		status, body, err := fn(r)
+		if err != nil {
+			var ae *apiError
+			if !errors.As(err, &ae) {
+				ae = &apiError{status: http.StatusInternalServerError, msg: err.Error()}
+			}
+			w.WriteHeader(ae.status)
+			json.NewEncoder(w).Encode(map[string]string{"error": ae.msg})
+			return
+		}
+		w.WriteHeader(status)
+		if body != nil {
+			json.NewEncoder(w).Encode(body)
+		}
+	}
+}
+
+func (s *apiServer) getServer(r *http.Request) (int, interface{}, error) {
+	return http.StatusOK, map[string]string{
+		"type":        "Server",
+		"id":          "localhost",
+		"daemon_type": "authoritative",
+		"version":     apiVersion,
+		"url":         apiPrefix,
+		"zones_url":   apiPrefix + "/zones{/zone}",
+	}, nil
+}
+
+func (s *apiServer) listZones(r *http.Request) (int, interface{}, error) {
+	query := s.backend.DB.Order("name")
+	if zone := r.URL.Query().Get("zone"); zone != "" {
+		query = query.Where("name = ?", normalizeName(zone))
+	}
+	var domains []pdnsmodel.Domain
+	if err := query.Find(&domains).Error; err != nil {
+		return 0, nil, err
+	}
+
+	zones := []apiZone{}
+	for _, d := range domains {
+		z := s.zone(&d)
+		if soa, err := s.soa(s.backend.DB, &d); err == nil && soa != nil {
+			z.Serial = soa.Serial
+		}
+		zones = append(zones, z)
+	}
+	return http.StatusOK, zones, nil
+}
+
+func (s *apiServer) getZone(r *http.Request) (int, interface{}, error) {
+	d, err := s.findZone(s.backend.DB, r.PathValue("zone"))
+	if err != nil {
+		return 0, nil, err
+	}
+	z, err := s.zoneWithRRsets(s.backend.DB, d)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, z, nil
+}
+
+func (s *apiServer) createZone(r *http.Request) (int, interface{}, error) {
+	var req apiZone
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return 0, nil, apiErrorf(http.StatusBadRequest, "invalid JSON: %v", err)
+	}
+	if _, ok := dns.IsDomainName(req.Name); !ok || !dns.IsFqdn(req.Name) {
+		return 0, nil, apiErrorf(http.StatusUnprocessableEntity, "zone name %q must be a canonical domain name", req.Name)
+	}
+	kind := strings.ToUpper(req.Kind)
+	switch kind {
+	case "":
+		kind = "NATIVE"
+	case "NATIVE", "MASTER", "SLAVE":
+	default:
+		return 0, nil, apiErrorf(http.StatusUnprocessableEntity, "unsupported zone kind %q", req.Kind)
+	}
+
+	var z apiZone
+	err := s.backend.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&pdnsmodel.Domain{}).Where("name = ?", normalizeName(req.Name)).Count(&count).Error; err != nil {
+			return err
+		}
+		if count != 0 {
+			return apiErrorf(http.StatusConflict, "domain %q already exists", req.Name)
+		}
+
+		d := &pdnsmodel.Domain{Name: normalizeName(req.Name), Type: kind}
+		if err := tx.Create(d).Error; err != nil {
+			return err
+		}
+
+		rrsets := req.RRsets
+		if !hasRRset(rrsets, req.Name, "SOA") {
+			rrsets = append(rrsets, apiRRset{Name: req.Name, Type: "SOA", TTL: 3600, Records: []apiRecord{{
+				Content: fmt.Sprintf("a.misconfigured.dns.server.invalid. hostmaster.%s %d 10800 3600 604800 3600", req.Name, s.serial(0)),
+			}}})
+		}
+		if len(req.Nameservers) != 0 && !hasRRset(rrsets, req.Name, "NS") {
+			ns := apiRRset{Name: req.Name, Type: "NS", TTL: 3600}
+			for _, n := range req.Nameservers {
+				ns.Records = append(ns.Records, apiRecord{Content: n})
+			}
+			rrsets = append(rrsets, ns)
+		}
+		for _, rrset := range rrsets {
+			if err := s.replaceRRset(tx, d, rrset); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		z, err = s.zoneWithRRsets(tx, d)
+		return err
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	s.changed(req.Name)
+	return http.StatusCreated, z, nil
+}
+
+func (s *apiServer) patchZone(r *http.Request) (int, interface{}, error) {
+	var req apiZone
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return 0, nil, apiErrorf(http.StatusBadRequest, "invalid JSON: %v", err)
+	}
+
+	var zone string
+	err := s.backend.DB.Transaction(func(tx *gorm.DB) error {
+		d, err := s.findZone(tx, r.PathValue("zone"))
+		if err != nil {
+			return err
+		}
+		zone = dns.Fqdn(d.Name)
+
+		soaChanged := false
+		for _, rrset := range req.RRsets {
+			switch strings.ToUpper(rrset.Changetype) {
+			case "REPLACE":
+				err = s.replaceRRset(tx, d, rrset)
+			case "DELETE":
+				err = s.deleteRRset(tx, d, rrset)
+			default:
+				err = apiErrorf(http.StatusUnprocessableEntity, "changetype %q is not supported", rrset.Changetype)
+			}
+			if err != nil {
+				return err
+			}
+			if strings.EqualFold(rrset.Type, "SOA") {
+				soaChanged = true
+			}
+		}
+		if soaChanged {
+			return nil
+		}
+		return s.bumpSerial(tx, d)
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	s.changed(zone)
+	return http.StatusNoContent, nil, nil
+}
+
+func (s *apiServer) deleteZone(r *http.Request) (int, interface{}, error) {
+	var zone string
+	err := s.backend.DB.Transaction(func(tx *gorm.DB) error {
+		d, err := s.findZone(tx, r.PathValue("zone"))
+		if err != nil {
+			return err
+		}
+		zone = dns.Fqdn(d.Name)
+		if err := tx.Where("domain_id = ?", d.ID).Delete(&pdnsmodel.Record{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(d).Error
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	s.changed(zone)
+	return http.StatusNoContent, nil, nil
+}
+
+func (s *apiServer) findZone(tx *gorm.DB, id string) (*pdnsmodel.Domain, error) {
+	var domains []pdnsmodel.Domain
+	if err := tx.Where("name = ?", normalizeName(id)).Limit(1).Find(&domains).Error; err != nil {
+		return nil, err
+	}
+	if len(domains) == 0 {
+		return nil, apiErrorf(http.StatusNotFound, "Could not find domain '%s'", id)
+	}
+	return &domains[0], nil
+}
+
+func (s *apiServer) zone(d *pdnsmodel.Domain) apiZone {
+	name := dns.Fqdn(d.Name)
+	kind := strings.ToUpper(d.Type)
+	if len(kind) > 1 {
+		kind = kind[:1] + strings.ToLower(kind[1:])
+	}
+	z := apiZone{ID: name, Name: name, Type: "Zone", URL: apiPrefix + "/zones/" + name, Kind: kind, Masters: []string{}}
+	if d.Account.Valid {
+		z.Account = d.Account.String
+	}
+	if d.Master.Valid && d.Master.String != "" {
+		z.Masters = strings.Split(d.Master.String, ",")
+	}
+	return z
+}
+
+func (s *apiServer) zoneWithRRsets(tx *gorm.DB, d *pdnsmodel.Domain) (apiZone, error) {
+	z := s.zone(d)
+
+	var records []*pdnsmodel.Record
+	if err := tx.Where("domain_id = ?", d.ID).Order("name, type, id").Find(&records).Error; err != nil {
+		return z, err
+	}
+	z.RRsets = []apiRRset{}
+	for _, rec := range records {
+		if rec.Type == "" {
+			// empty non-terminal
+			continue
+		}
+		name, typ := dns.Fqdn(rec.Name), rec.Type
+		if n := len(z.RRsets); n == 0 || z.RRsets[n-1].Name != name || z.RRsets[n-1].Type != typ {
+			z.RRsets = append(z.RRsets, apiRRset{Name: name, Type: typ, TTL: rec.Ttl, Comments: []interface{}{}})
+		}
+		rrset := &z.RRsets[len(z.RRsets)-1]
+		rrset.Records = append(rrset.Records, apiRecord{Content: presentation(rec), Disabled: rec.Disabled})
+
+		if typ == "SOA" {
+			soa := new(dns.SOA)
+			if ParseSOA(soa, rec.Content) {
+				z.Serial = soa.Serial
+			}
+		}
+	}
+	return z, nil
+}
+
+// replaceRRset replaces the records of the rrset name and type inside d.
+func (s *apiServer) replaceRRset(tx *gorm.DB, d *pdnsmodel.Domain, rrset apiRRset) error {
+	if err := s.deleteRRset(tx, d, rrset); err != nil {
+		return err
+	}
+	typ := strings.ToUpper(rrset.Type)
+	for _, rec := range rrset.Records {
+		var rr dns.RR
+		var err error
+		if apiPseudoTypes[typ] {
+			rr, err = ToRR(&pdnsmodel.Record{Name: rrset.Name, Type: typ, Content: rec.Content, Ttl: rrset.TTL}, dns.ClassINET)
+		} else {
+			rr, err = dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(rrset.Name), rrset.TTL, typ, rec.Content))
+		}
+		if err != nil || rr == nil {
+			return apiErrorf(http.StatusUnprocessableEntity, "record %s/%s '%s': unable to parse: %v", rrset.Name, typ, rec.Content, err)
+		}
+		row := FromRR(rr)
+		row.DomainId = d.ID
+		row.Disabled = rec.Disabled
+		row.ChangeDate = int(s.now().Unix())
+		if err := tx.Create(row).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apiPseudoTypes are the PowerDNS types served by pdsql which miekg/dns does not know.
+var apiPseudoTypes = map[string]bool{"ALIAS": true, "LUA": true}
+
+// deleteRRset removes the records of the rrset name and type inside d.
+func (s *apiServer) deleteRRset(tx *gorm.DB, d *pdnsmodel.Domain, rrset apiRRset) error {
+	zone := dns.Fqdn(d.Name)
+	name := strings.ToLower(dns.Fqdn(rrset.Name))
+	if !dns.IsFqdn(rrset.Name) || !dns.IsSubDomain(zone, name) {
+		return apiErrorf(http.StatusUnprocessableEntity, "RRset %s IN %s: Name is out of zone", rrset.Name, rrset.Type)
+	}
+	typ := strings.ToUpper(rrset.Type)
+	if _, ok := dns.StringToType[typ]; !ok && !apiPseudoTypes[typ] {
+		return apiErrorf(http.StatusUnprocessableEntity, "RRset %s: unknown type %q", rrset.Name, rrset.Type)
+	}
+	return tx.Where("domain_id = ? AND name = ? AND type = ?", d.ID, normalizeName(name), typ).
+		Delete(&pdnsmodel.Record{}).Error
+}
+
+func (s *apiServer) soa(tx *gorm.DB, d *pdnsmodel.Domain) (*dns.SOA, error) {
+	var records []pdnsmodel.Record
+	if err := tx.Where("domain_id = ? AND name = ? AND type = ?", d.ID, d.Name, "SOA").Limit(1).Find(&records).Error; err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	soa := new(dns.SOA)
+	if !ParseSOA(soa, records[0].Content) {
+		return nil, fmt.Errorf("invalid SOA content: %s", records[0].Content)
+	}
+	return soa, nil
+}
+
+// bumpSerial increases the serial of the zone SOA, using the YYYYMMDDnn format when it is larger.
+func (s *apiServer) bumpSerial(tx *gorm.DB, d *pdnsmodel.Domain) error {
+	soa, err := s.soa(tx, d)
+	if err != nil || soa == nil {
+		return err
+	}
+	soa.Hdr = dns.RR_Header{Name: dns.Fqdn(d.Name), Rrtype: dns.TypeSOA, Class: dns.ClassINET}
+	soa.Serial = s.serial(soa.Serial)
+	return tx.Model(&pdnsmodel.Record{}).
+		Where("domain_id = ? AND name = ? AND type = ?", d.ID, d.Name, "SOA").
+		Updates(map[string]interface{}{"content": FromRR(soa).Content, "change_date": s.now().Unix()}).Error
+}
+
+func (s *apiServer) serial(old uint32) uint32 {
+	date, _ := strconv.ParseUint(s.now().UTC().Format("20060102")+"00", 10, 32)
+	if uint32(date) > old {
+		return uint32(date)
+	}
+	return old + 1
+}
+
+// changed drops the stale answers of the zone and notifies the secondaries.
+func (s *apiServer) changed(zone string) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	s.backend.stale.Purge(zone)
+	if s.transfer != nil {
+		go func() {
+			if err := s.transfer.Notify(zone); err != nil {
+				log.Warningf("notify failed zone=%s error=%q", zone, err)
+			}
+		}()
+	}
+}
+
+func hasRRset(rrsets []apiRRset, name, typ string) bool {
+	for _, rrset := range rrsets {
+		if strings.EqualFold(rrset.Name, name) && strings.EqualFold(rrset.Type, typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// presentation returns the content of rec in zone file format.
+func presentation(rec *pdnsmodel.Record) string {
+	switch rec.Type {
+	case "ALIAS":
+		return dns.Fqdn(rec.Content)
+	case "LUA":
+		return rec.Content
+	}
+	rr, err := ToRR(rec, dns.ClassINET)
+	if err != nil || rr == nil {
+		return rec.Content
+	}
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
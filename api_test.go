@@ -0,0 +1,203 @@
+package pdsql
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+func TestAPI(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{DB: db}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	api := newAPIServer(p, "", "secret")
+	api.now = func() time.Time { return time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC) }
+	srv := httptest.NewServer(api.Handler())
+	defer srv.Close()
+
+	call := func(method, path, key, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest(method, srv.URL+apiPrefix+path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	if code, _ := call("GET", "/zones", "wrong", ""); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 with wrong key, but got %d", code)
+	}
+
+	code, zone := call("POST", "/zones", "secret", `{"name":"example.org.","kind":"Native","nameservers":["ns1.example.org."]}`)
+	if code != http.StatusCreated {
+		t.Fatalf("Expected 201, but got %d %v", code, zone)
+	}
+	if zone["serial"].(float64) != 2024050100 {
+		t.Errorf("Expected serial 2024050100, but got %v", zone["serial"])
+	}
+	if code, _ := call("POST", "/zones", "secret", `{"name":"example.org.","kind":"Native"}`); code != http.StatusConflict {
+		t.Errorf("Expected 409 for existing zone, but got %d", code)
+	}
+
+	code, out := call("PATCH", "/zones/example.org.", "secret", `{"rrsets":[
+		{"name":"www.example.org.","type":"A","ttl":300,"changetype":"REPLACE","records":[{"content":"192.168.1.1","disabled":false},{"content":"192.168.1.2","disabled":false}]},
+		{"name":"example.org.","type":"MX","ttl":300,"changetype":"REPLACE","records":[{"content":"10 mail.example.org.","disabled":false}]},
+		{"name":"example.org.","type":"TXT","ttl":300,"changetype":"REPLACE","records":[{"content":"\"hello world\"","disabled":false}]}
+	]}`)
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected 204, but got %d %v", code, out)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := p.ServeDNS(context.TODO(), rec, req); err != nil || len(rec.Msg.Answer) != 2 {
+		t.Fatalf("Expected 2 answers, but got %v err %v", rec.Msg, err)
+	}
+
+	code, zone = call("GET", "/zones/example.org.", "secret", "")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, but got %d", code)
+	}
+	if zone["serial"].(float64) != 2024050101 {
+		t.Errorf("Expected bumped serial 2024050101, but got %v", zone["serial"])
+	}
+	contents := map[string]string{}
+	for _, v := range zone["rrsets"].([]interface{}) {
+		rrset := v.(map[string]interface{})
+		record := rrset["records"].([]interface{})[0].(map[string]interface{})
+		contents[rrset["name"].(string)+" "+rrset["type"].(string)] = record["content"].(string)
+	}
+	for k, v := range map[string]string{
+		"example.org. MX":  "10 mail.example.org.",
+		"example.org. TXT": `"hello world"`,
+		"example.org. NS":  "ns1.example.org.",
+	} {
+		if contents[k] != v {
+			t.Errorf("Expected %s content %s, but got %s", k, v, contents[k])
+		}
+	}
+
+	code, _ = call("PATCH", "/zones/example.org.", "secret", `{"rrsets":[{"name":"www.example.org.","type":"A","changetype":"DELETE"}]}`)
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected 204, but got %d", code)
+	}
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	p.ServeDNS(context.TODO(), rec, req)
+	if rec.Msg != nil && len(rec.Msg.Answer) != 0 {
+		t.Errorf("Expected deleted rrset, but got %v", rec.Msg.Answer)
+	}
+
+	if code, _ := call("PATCH", "/zones/example.org.", "secret", `{"rrsets":[{"name":"www.example.net.","type":"A","ttl":1,"changetype":"REPLACE","records":[{"content":"192.168.1.1"}]}]}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for out of zone rrset, but got %d", code)
+	}
+	if code, _ := call("PATCH", "/zones/example.org.", "secret", `{"rrsets":[{"name":"www.example.org.","type":"A","ttl":1,"changetype":"REPLACE","records":[{"content":"invalid"}]}]}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for invalid content, but got %d", code)
+	}
+
+	code, _ = call("PATCH", "/zones/example.org.", "secret", `{"rrsets":[{"name":"example.org.","type":"ALIAS","ttl":300,"changetype":"REPLACE","records":[{"content":"lb.example.net.","disabled":false}]}]}`)
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected 204 for ALIAS rrset, but got %d", code)
+	}
+	var alias pdnsmodel.Record
+	if err := p.DB.Where("name = ? AND type = ?", "example.org", "ALIAS").First(&alias).Error; err != nil || alias.Content != "lb.example.net" {
+		t.Errorf("Expected ALIAS content lb.example.net, but got %q err %v", alias.Content, err)
+	}
+	code, _ = call("PATCH", "/zones/example.org.", "secret", `{"rrsets":[{"name":"example.org.","type":"ALIAS","changetype":"DELETE"}]}`)
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected 204 for deleted ALIAS rrset, but got %d", code)
+	}
+	var aliases int64
+	p.DB.Model(&pdnsmodel.Record{}).Where("type = ?", "ALIAS").Count(&aliases)
+	if aliases != 0 {
+		t.Errorf("Expected deleted ALIAS rrset, but got %d records", aliases)
+	}
+
+	code, _ = call("PATCH", "/zones/example.org.", "secret", `{"rrsets":[{"name":"lua.example.org.","type":"LUA","ttl":60,"changetype":"REPLACE","records":[{"content":"A \"pickrandom({'192.0.2.1'})\"","disabled":false}]}]}`)
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected 204 for LUA rrset, but got %d", code)
+	}
+	_, zone = call("GET", "/zones/example.org.", "secret", "")
+	found := false
+	for _, v := range zone["rrsets"].([]interface{}) {
+		rrset := v.(map[string]interface{})
+		if rrset["type"] == "LUA" {
+			found = rrset["records"].([]interface{})[0].(map[string]interface{})["content"] == `A "pickrandom({'192.0.2.1'})"`
+		}
+	}
+	if !found {
+		t.Errorf("Expected the LUA rrset, but got %v", zone["rrsets"])
+	}
+	if code, _ := call("PATCH", "/zones/example.org.", "secret", `{"rrsets":[{"name":"lua.example.org.","type":"LUA","ttl":60,"changetype":"REPLACE","records":[{"content":"A \"192.0.2.1\""}]}]}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a LUA script which does not compile, but got %d", code)
+	}
+	if code, _ := call("PATCH", "/zones/example.org.", "secret", `{"rrsets":[{"name":"lua.example.org.","type":"LUA","changetype":"DELETE"}]}`); code != http.StatusNoContent {
+		t.Errorf("Expected 204 for deleted LUA rrset, but got %d", code)
+	}
+
+	if code, _ := call("DELETE", "/zones/example.org.", "secret", ""); code != http.StatusNoContent {
+		t.Fatalf("Expected 204, but got %d", code)
+	}
+	if code, _ := call("GET", "/zones/example.org.", "secret", ""); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for deleted zone, but got %d", code)
+	}
+	var count int64
+	p.DB.Table("records").Count(&count)
+	if count != 0 {
+		t.Errorf("Expected records of the zone to be deleted, but got %d", count)
+	}
+}
+
+func TestAPIRestart(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	old := newAPIServer(PowerDNSGenericSQLBackend{}, addr, "secret")
+	if err := old.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// a reload stops the old listener before the new instance starts
+	if err := old.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newAPIServer(PowerDNSGenericSQLBackend{}, addr, "secret")
+	if err := reloaded.Start(); err != nil {
+		t.Fatalf("Expected the new instance to bind %s, but got %v", addr, err)
+	}
+	if err := reloaded.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	// a failed reload starts the old listener again
+	if err := old.Start(); err != nil {
+		t.Fatalf("Expected the old instance to bind %s again, but got %v", addr, err)
+	}
+	old.Stop()
+	old.Stop()
+}
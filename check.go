@@ -0,0 +1,189 @@
+package pdsql
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/miekg/dns"
+	"gorm.io/gorm"
+)
+
+// Severity of a Problem found by CheckZone.
+type Severity string
+
+const (
+	// SeverityError marks records which break answers.
+	SeverityError Severity = "error"
+	// SeverityWarning marks records which are suspicious or ignored.
+	SeverityWarning Severity = "warning"
+)
+
+// Problem is an issue found in the records of a zone.
+type Problem struct {
+	Severity Severity
+	// RecordID is the id of the offending row, 0 for problems of the whole zone.
+	RecordID uint
+	Name     string
+	Type     string
+	Message  string
+}
+
+func (p Problem) String() string {
+	if p.RecordID == 0 {
+		return fmt.Sprintf("%s: %s %s: %s", p.Severity, p.Name, p.Type, p.Message)
+	}
+	return fmt.Sprintf("%s: record %d %s %s: %s", p.Severity, p.RecordID, p.Name, p.Type, p.Message)
+}
+
+// CheckZone scans the enabled records of a domain for content pdsql can not serve, CNAME conflicts,
+// a missing apex SOA or NS, rows with the wrong domain_id, uppercase names, duplicates and
+// inconsistent TTLs within an RRset.
+func CheckZone(db *gorm.DB, zone string) ([]Problem, error) {
+	name := normalizeName(zone)
+
+	var domains []pdnsmodel.Domain
+	if err := db.Where("name = ?", name).Limit(1).Find(&domains).Error; err != nil {
+		return nil, err
+	}
+	if len(domains) == 0 {
+		return nil, ErrZoneNotFound
+	}
+	domain := domains[0]
+
+	var records []*pdnsmodel.Record
+	if err := db.Where("domain_id = ?", domain.ID).Where("disabled = ?", false).Order("name, type, id").Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	report := func(severity Severity, r *pdnsmodel.Record, format string, args ...interface{}) {
+		problems = append(problems, Problem{Severity: severity, RecordID: r.ID, Name: r.Name, Type: r.Type, Message: fmt.Sprintf(format, args...)})
+	}
+
+	types := map[string]map[string]bool{}
+	rrsets := map[[2]string][]*pdnsmodel.Record{}
+	for _, r := range records {
+		if r.Name != strings.ToLower(r.Name) {
+			report(SeverityError, r, "name is not lower case, lookups will not find it")
+		}
+		if strings.HasSuffix(r.Name, ".") {
+			report(SeverityError, r, "name has a trailing dot")
+		}
+		if !dns.IsSubDomain(name, strings.ToLower(r.Name)) {
+			report(SeverityError, r, "name is outside of zone %s", name)
+		}
+		if r.Type == "" {
+			// empty non-terminal
+			continue
+		}
+
+		checkContent(r, report)
+
+		key := [2]string{strings.ToLower(r.Name), r.Type}
+		rrsets[key] = append(rrsets[key], r)
+		if types[key[0]] == nil {
+			types[key[0]] = map[string]bool{}
+		}
+		types[key[0]][r.Type] = true
+	}
+
+	for owner, set := range types {
+		if set["CNAME"] && len(set) > 1 {
+			var others []string
+			for t := range set {
+				if t != "CNAME" {
+					others = append(others, t)
+				}
+			}
+			sort.Strings(others)
+			problems = append(problems, Problem{Severity: SeverityError, Name: owner, Type: "CNAME", Message: "CNAME and other data: " + strings.Join(others, ", ")})
+		}
+	}
+	if !types[name]["SOA"] {
+		problems = append(problems, Problem{Severity: SeverityError, Name: name, Type: "SOA", Message: "zone apex has no SOA record"})
+	}
+	if !types[name]["NS"] {
+		problems = append(problems, Problem{Severity: SeverityWarning, Name: name, Type: "NS", Message: "zone apex has no NS records"})
+	}
+
+	for _, set := range rrsets {
+		seen := map[string]*pdnsmodel.Record{}
+		for _, r := range set {
+			if r.Ttl != set[0].Ttl {
+				report(SeverityWarning, r, "TTL %d differs from %d of record %d in the same RRset", r.Ttl, set[0].Ttl, set[0].ID)
+			}
+			key := fmt.Sprintf("%d %s", r.Prio, r.Content)
+			if first, ok := seen[key]; ok {
+				report(SeverityWarning, r, "duplicate of record %d", first.ID)
+			} else {
+				seen[key] = r
+			}
+		}
+	}
+
+	foreign, err := foreignRecords(db, domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range foreign {
+		report(SeverityError, r, "name is inside zone %s but domain_id is %d instead of %d", name, r.DomainId, domain.ID)
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Name != problems[j].Name {
+			return compareNames(problems[i].Name, problems[j].Name) < 0
+		}
+		return problems[i].RecordID < problems[j].RecordID
+	})
+	return problems, nil
+}
+
+// checkContent reports records whose content can not be converted to an answer.
+func checkContent(r *pdnsmodel.Record, report func(Severity, *pdnsmodel.Record, string, ...interface{})) {
+	rr, err := ToRR(r, dns.ClassINET)
+	var re *RecordError
+	switch {
+	case errors.As(err, &re):
+		report(SeverityError, r, "%s", re.Reason)
+	case err != nil:
+		report(SeverityError, r, "%v", err)
+	case rr == nil:
+		report(SeverityWarning, r, "type is not served by pdsql")
+	}
+}
+
+// foreignRecords returns the records named inside domain which belong to neither domain
+// nor one of its sub zones.
+func foreignRecords(db *gorm.DB, domain pdnsmodel.Domain) ([]*pdnsmodel.Record, error) {
+	var subs []pdnsmodel.Domain
+	if err := db.Where("name LIKE ?", "%."+domain.Name).Find(&subs).Error; err != nil {
+		return nil, err
+	}
+
+	var records []*pdnsmodel.Record
+	if err := db.Where("domain_id <> ?", domain.ID).
+		Where("name = ? OR name LIKE ?", domain.Name, "%."+domain.Name).
+		Where("disabled = ?", false).
+		Order("name, type, id").
+		Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	var foreign []*pdnsmodel.Record
+	for _, r := range records {
+		owner := domain
+		for _, sub := range subs {
+			if dns.IsSubDomain(sub.Name, r.Name) && len(sub.Name) > len(owner.Name) {
+				owner = sub
+			}
+		}
+		if owner.ID == domain.ID {
+			foreign = append(foreign, r)
+		}
+	}
+	return foreign, nil
+}
@@ -0,0 +1,95 @@
+package pdsql_test
+
+import (
+	"testing"
+
+	pdsql "github.com/wenerme/coredns-pdsql"
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+)
+
+func TestCheckZone(t *testing.T) {
+	p := newZoneBackend(t)
+	zone := &pdnsmodel.Domain{Name: "example.org", Type: "NATIVE"}
+	sub := &pdnsmodel.Domain{Name: "sub.example.org", Type: "NATIVE"}
+	for _, d := range []*pdnsmodel.Domain{zone, sub} {
+		if err := p.DB.Create(d).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records := []pdnsmodel.Record{
+		{Name: "example.org", DomainId: zone.ID, Type: "SOA", Content: "ns1 hostmaster invalid", Ttl: 3600},
+		{Name: "example.org", DomainId: zone.ID, Type: "MX", Content: "ten mail.example.org", Ttl: 3600},
+		{Name: "_sip._udp.example.org", DomainId: zone.ID, Type: "SRV", Content: "10 5060", Ttl: 3600},
+		{Name: "www.example.org", DomainId: zone.ID, Type: "CNAME", Content: "example.org", Ttl: 3600},
+		{Name: "www.example.org", DomainId: zone.ID, Type: "TXT", Content: "conflict", Ttl: 3600},
+		{Name: "Upper.example.org", DomainId: zone.ID, Type: "A", Content: "192.168.1.1", Ttl: 3600},
+		{Name: "multi.example.org", DomainId: zone.ID, Type: "A", Content: "192.168.1.1", Ttl: 3600},
+		{Name: "multi.example.org", DomainId: zone.ID, Type: "A", Content: "192.168.1.2", Ttl: 60},
+		{Name: "multi.example.org", DomainId: zone.ID, Type: "A", Content: "192.168.1.1", Ttl: 3600},
+		{Name: "bad.example.org", DomainId: zone.ID, Type: "A", Content: "::1", Ttl: 3600},
+		{Name: "other.example.net", DomainId: zone.ID, Type: "A", Content: "192.168.1.1", Ttl: 3600},
+		{Name: "lost.example.org", DomainId: 0, Type: "A", Content: "192.168.1.1", Ttl: 3600},
+		{Name: "www.sub.example.org", DomainId: sub.ID, Type: "A", Content: "192.168.1.1", Ttl: 3600},
+		{Name: "off.example.org", DomainId: zone.ID, Type: "A", Content: "invalid", Ttl: 3600, Disabled: true},
+		{Name: "lua.example.org", DomainId: zone.ID, Type: "LUA", Content: `A "pickrandom({'192.168.1.1'})"`, Ttl: 60},
+		{Name: "lua.example.org", DomainId: zone.ID, Type: "LUA", Content: `AAAA ";return {"`, Ttl: 60},
+		{Name: "luatype.example.org", DomainId: zone.ID, Type: "LUA", Content: `BOGUS "'192.168.1.1'"`, Ttl: 60},
+	}
+	for _, r := range records {
+		if err := p.DB.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := pdsql.CheckZone(p.DB, "example.org.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]pdsql.Severity{
+		"example.org SOA invalid SOA":                 pdsql.SeverityError,
+		"example.org NS zone apex has no NS":          pdsql.SeverityWarning,
+		"example.org MX invalid MX preference":        pdsql.SeverityError,
+		"_sip._udp.example.org SRV malformed SRV":     pdsql.SeverityError,
+		"www.example.org CNAME CNAME and other data":  pdsql.SeverityError,
+		"Upper.example.org A name is not lower case":  pdsql.SeverityError,
+		"multi.example.org A TTL 60 differs":          pdsql.SeverityWarning,
+		"multi.example.org A duplicate of record":     pdsql.SeverityWarning,
+		"bad.example.org A invalid IPv4":              pdsql.SeverityError,
+		"other.example.net A name is outside of zone": pdsql.SeverityError,
+		"lost.example.org A name is inside zone":      pdsql.SeverityError,
+		"lua.example.org LUA lua:":                    pdsql.SeverityError,
+		"luatype.example.org LUA invalid LUA record":  pdsql.SeverityError,
+	}
+	found := map[string]bool{}
+	for _, problem := range problems {
+		matched := false
+		for prefix, severity := range expected {
+			if hasProblem(problem, prefix) {
+				if problem.Severity != severity {
+					t.Errorf("Expected %q to be %s, but got %s", prefix, severity, problem.Severity)
+				}
+				found[prefix] = true
+				matched = true
+			}
+		}
+		if !matched {
+			t.Errorf("Unexpected problem %s", problem)
+		}
+	}
+	for prefix := range expected {
+		if !found[prefix] {
+			t.Errorf("Expected problem %q", prefix)
+		}
+	}
+
+	if _, err := pdsql.CheckZone(p.DB, "example.net."); err != pdsql.ErrZoneNotFound {
+		t.Errorf("Expected ErrZoneNotFound, but got %v", err)
+	}
+}
+
+func hasProblem(p pdsql.Problem, prefix string) bool {
+	s := p.Name + " " + p.Type + " " + p.Message
+	return len(s) >= len(prefix) && s[:len(prefix)] == prefix
+}
@@ -0,0 +1,203 @@
+package pdsql
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCheckInterval = 5 * time.Second
+	defaultCheckTimeout  = 2 * time.Second
+	// checkExpire drops the checks no answer asked for in this long.
+	checkExpire = time.Hour
+)
+
+// targetCheck is a probe of one address, probed in the background by a targetChecker.
+type targetCheck struct {
+	probe func(ctx context.Context) error
+	up    bool
+	known bool
+	used  time.Time
+}
+
+// targetChecker probes the addresses of dynamic answers in the background, answers only read
+// the result of the last probe. Checks are created on first use and dropped when unused, the
+// background probes start with the first check.
+type targetChecker struct {
+	interval time.Duration
+	timeout  time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	checks  map[string]*targetCheck
+	cancel  context.CancelFunc
+	done    chan struct{}
+	stopped bool
+}
+
+func newTargetChecker(interval, timeout time.Duration) *targetChecker {
+	return &targetChecker{interval: interval, timeout: timeout, now: time.Now, checks: make(map[string]*targetCheck)}
+}
+
+// Up reports whether the last probe of key succeeded, a target not probed yet is up.
+// The first call for a key registers probe and runs it in the background.
+func (c *targetChecker) Up(key string, probe func(ctx context.Context) error) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	check, ok := c.checks[key]
+	if !ok {
+		check = &targetCheck{probe: probe}
+		c.checks[key] = check
+		c.start()
+	}
+	check.used = c.now()
+	up := check.up || !check.known
+	c.mu.Unlock()
+
+	if !ok {
+		go c.run(context.Background(), key, check)
+	}
+	return up
+}
+
+// CheckAll probes every target once and drops the expired ones.
+func (c *targetChecker) CheckAll(ctx context.Context) {
+	c.mu.Lock()
+	checks := make(map[string]*targetCheck, len(c.checks))
+	for key, check := range c.checks {
+		if c.now().Sub(check.used) > checkExpire {
+			delete(c.checks, key)
+			continue
+		}
+		checks[key] = check
+	}
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for key, check := range checks {
+		wg.Add(1)
+		go func(key string, check *targetCheck) {
+			defer wg.Done()
+			c.run(ctx, key, check)
+		}(key, check)
+	}
+	wg.Wait()
+}
+
+func (c *targetChecker) run(ctx context.Context, key string, check *targetCheck) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	err := check.probe(ctx)
+
+	c.mu.Lock()
+	changed := check.known && check.up != (err == nil)
+	check.up, check.known = err == nil, true
+	c.mu.Unlock()
+
+	switch {
+	case changed && err != nil:
+		log.Warningf("target down check=%q error=%q", key, err)
+	case changed:
+		log.Infof("target up check=%q", key)
+	}
+}
+
+// start runs CheckAll every interval until Stop, c.mu is held.
+func (c *targetChecker) start() {
+	if c.cancel != nil || c.stopped {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.CheckAll(ctx)
+			}
+		}
+	}()
+}
+
+func (c *targetChecker) Stop() error {
+	c.mu.Lock()
+	c.stopped = true
+	cancel, done := c.cancel, c.done
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	return nil
+}
+
+// probeTCP returns a probe connecting to addr.
+func probeTCP(addr string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// probeURL returns a probe fetching rawURL from the server at ip, the host of the URL is kept
+// for the Host header and TLS. Status codes from 400 on are failures.
+func probeURL(rawURL, ip string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return err
+		}
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			},
+			TLSClientConfig:   &tls.Config{ServerName: u.Hostname()},
+			DisableKeepAlives: true,
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{
+			Transport: transport,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("status %s", resp.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,62 @@
+package pdsql
+
+import (
+	"os"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// classFallthrough is the class policy passing non IN queries to the next plugin.
+const classFallthrough = -1
+
+// classPolicies maps the class-policy option to the rcode of non IN queries.
+var classPolicies = map[string]int{
+	"refuse":      dns.RcodeRefused,
+	"notimp":      dns.RcodeNotImplemented,
+	"fallthrough": classFallthrough,
+}
+
+// defaultChaosText returns the text served for the usual CHAOS names when the chaos option gives none.
+func defaultChaosText(name string) []string {
+	switch strings.ToLower(dns.Fqdn(name)) {
+	case "version.bind.", "version.server.":
+		return []string{"pdsql"}
+	case "hostname.bind.", "id.server.":
+		if host, err := os.Hostname(); err == nil {
+			return []string{host}
+		}
+		return []string{"localhost"}
+	}
+	return nil
+}
+
+// serveClass answers queries which are not in the IN class, the records table only holds IN data.
+func (pdb PowerDNSGenericSQLBackend) serveClass(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state request.Request, l metricLabels) (int, error) {
+	if state.QClass() == dns.ClassCHAOS {
+		if txt, ok := pdb.chaos[state.Name()]; ok {
+			a := new(dns.Msg)
+			a.SetReply(r)
+			a.Authoritative = true
+			if state.QType() == dns.TypeTXT || state.QType() == dns.TypeANY {
+				hdr := dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS}
+				a.Answer = []dns.RR{&dns.TXT{Hdr: hdr, Txt: txt}}
+			}
+			responseCount.WithLabelValues(l.server, l.zone, dns.RcodeToString[a.Rcode]).Inc()
+			return 0, writeMsg(state, a)
+		}
+	}
+
+	if pdb.classPolicy == classFallthrough {
+		return plugin.NextOrFailure(pdb.Name(), pdb.Next, ctx, w, r)
+	}
+	rcode := pdb.classPolicy
+	if rcode == 0 {
+		rcode = dns.RcodeRefused
+	}
+	responseCount.WithLabelValues(l.server, l.zone, dns.RcodeToString[rcode]).Inc()
+	return rcode, nil
+}
@@ -0,0 +1,61 @@
+package pdsql
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+func TestServeClass(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{
+		DB:    db,
+		Next:  test.NextHandler(dns.RcodeNameError, nil),
+		chaos: map[string][]string{"version.bind.": {"pdsql test"}},
+	}
+
+	query := func(name string, qtype, qclass uint16) (int, *dns.Msg) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.Question[0].Qclass = qclass
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		code, err := p.ServeDNS(context.TODO(), rec, req)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, but got %v", name, err)
+		}
+		return code, rec.Msg
+	}
+
+	code, msg := query("VERSION.bind.", dns.TypeTXT, dns.ClassCHAOS)
+	if code != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("Expected a CHAOS TXT answer, but got code %d msg %v", code, msg)
+	}
+	if txt := msg.Answer[0].(*dns.TXT); txt.Hdr.Class != dns.ClassCHAOS || txt.Txt[0] != "pdsql test" {
+		t.Errorf("Expected CH TXT \"pdsql test\", but got %v", txt)
+	}
+
+	if code, _ := query("example.org.", dns.TypeA, dns.ClassCHAOS); code != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED for CH A, but got %d", code)
+	}
+	if code, _ := query("example.org.", dns.TypeA, dns.ClassHESIOD); code != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED for HS A, but got %d", code)
+	}
+
+	p.classPolicy = classPolicies["notimp"]
+	if code, _ := query("example.org.", dns.TypeA, dns.ClassCHAOS); code != dns.RcodeNotImplemented {
+		t.Errorf("Expected NOTIMP, but got %d", code)
+	}
+
+	p.classPolicy = classPolicies["fallthrough"]
+	if code, _ := query("example.org.", dns.TypeA, dns.ClassCHAOS); code != dns.RcodeNameError {
+		t.Errorf("Expected the next plugin's NXDOMAIN, but got %d", code)
+	}
+}
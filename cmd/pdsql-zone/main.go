@@ -0,0 +1,197 @@
+// Command pdsql-zone manages the zones stored in a PowerDNS generic SQL database.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	pdsql "github.com/wenerme/coredns-pdsql"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const usage = `Usage: pdsql-zone <command> [flags] [args]
+
+Commands:
+  import      import an RFC 1035 master file into the database
+  export      write a zone from the database as an RFC 1035 master file
+  check-zone  report malformed or inconsistent records of a zone
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "import":
+		err = importCmd(os.Args[2:])
+	case "export":
+		err = exportCmd(os.Args[2:])
+	case "check-zone":
+		err = checkCmd(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "pdsql-zone:", err)
+		os.Exit(1)
+	}
+}
+
+// dbFlags registers the database flags shared by all commands.
+func dbFlags(fs *flag.FlagSet) func() (*gorm.DB, error) {
+	dialect := fs.String("dialect", "sqlite3", "database dialect: sqlite3, mysql or postgres")
+	dsn := fs.String("dsn", "", "database connection string")
+	debug := fs.Bool("debug", false, "log SQL statements")
+	return func() (*gorm.DB, error) {
+		if *dsn == "" {
+			return nil, fmt.Errorf("-dsn is required")
+		}
+		dialector, err := pdsql.Dialector(*dialect, *dsn)
+		if err != nil {
+			return nil, err
+		}
+		level := logger.Warn
+		if *debug {
+			level = logger.Info
+		}
+		return gorm.Open(dialector, &gorm.Config{Logger: logger.Default.LogMode(level)})
+	}
+}
+
+func importCmd(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	open := dbFlags(fs)
+	origin := fs.String("origin", "", "zone origin, defaults to the owner of the SOA record")
+	kind := fs.String("kind", "NATIVE", "kind of a newly created domain")
+	mode := fs.String("mode", string(pdsql.ImportMerge), "merge replaces the imported rrsets, replace deletes all records of the domain first")
+	dryRun := fs.Bool("dry-run", false, "report the changes without committing them")
+	migrate := fs.Bool("auto-migrate", false, "create the tables when they do not exist")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pdsql-zone import [flags] FILE")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var r io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db, err := open()
+	if err != nil {
+		return err
+	}
+	if *migrate {
+		if err := (pdsql.PowerDNSGenericSQLBackend{DB: db}).AutoMigrate(); err != nil {
+			return err
+		}
+	}
+	res, err := pdsql.ImportZone(db, r, pdsql.ImportOptions{
+		Origin: *origin,
+		Kind:   *kind,
+		Mode:   pdsql.ImportMode(*mode),
+		DryRun: *dryRun,
+	})
+	if err != nil {
+		return err
+	}
+
+	action := "updated"
+	if res.Created {
+		action = "created"
+	}
+	if *dryRun {
+		action = "would be " + action
+	}
+	fmt.Printf("zone %s %s: %d records added, %d deleted\n", res.Domain.Name, action, res.Added, res.Deleted)
+	return nil
+}
+
+func exportCmd(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	open := dbFlags(fs)
+	output := fs.String("o", "-", "output file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pdsql-zone export [flags] ZONE")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db, err := open()
+	if err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		return pdsql.ExportZone(db, fs.Arg(0), os.Stdout)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := pdsql.ExportZone(db, fs.Arg(0), f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func checkCmd(args []string) error {
+	fs := flag.NewFlagSet("check-zone", flag.ExitOnError)
+	open := dbFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pdsql-zone check-zone [flags] ZONE")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db, err := open()
+	if err != nil {
+		return err
+	}
+	problems, err := pdsql.CheckZone(db, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	errors := 0
+	for _, p := range problems {
+		fmt.Println(p)
+		if p.Severity == pdsql.SeverityError {
+			errors++
+		}
+	}
+	if errors != 0 {
+		return fmt.Errorf("zone %s has %d errors", fs.Arg(0), errors)
+	}
+	fmt.Printf("zone %s has no errors, %d warnings\n", fs.Arg(0), len(problems))
+	return nil
+}
@@ -0,0 +1,215 @@
+package pdsql
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+// ErrNotConnected is returned instead of querying the database until a lazy connection succeeded.
+var ErrNotConnected = errors.New("pdsql: database not connected yet")
+
+const (
+	minConnectBackoff = time.Second
+	maxConnectBackoff = time.Minute
+)
+
+// sharedDBs holds one connection pool per dialect and DSN, shared by the server blocks using it.
+// On reload the new instance acquires the pools before the old one releases them, so unchanged
+// DSNs keep their pool and changed ones are closed only after the old servers stopped.
+var sharedDBs = &dbRegistry{dbs: make(map[dbKey]*sharedDB)}
+
+type dbKey struct {
+	dialect, dsn string
+}
+
+type sharedDB struct {
+	db   *gorm.DB
+	refs int
+	// connected is set once the pool reached the database, a lazy instance created on
+	// reload starts out connected then.
+	connected bool
+}
+
+type dbRegistry struct {
+	mu  sync.Mutex
+	dbs map[dbKey]*sharedDB
+}
+
+// Acquire returns the pool for dialect and dsn, opening it on first use. A lazy pool is opened
+// without connecting to the database.
+func (r *dbRegistry) Acquire(dialect, dsn string, lazy bool) (*gorm.DB, error) {
+	dialector, err := Dialector(dialect, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := dialector.(*mysql.Dialector); ok && lazy {
+		// the server version query needs a connection
+		d.Config.SkipInitializeWithVersion = true
+	}
+	key := dbKey{dialect: dialector.Name(), dsn: dsn}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.dbs[key]; ok {
+		s.refs++
+		return s.db, nil
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{Logger: newGormLogger(), DisableAutomaticPing: lazy})
+	if err != nil {
+		return nil, err
+	}
+	if err := registerCallbacks(db); err != nil {
+		return nil, err
+	}
+	// without lazy the pool was pinged when opened
+	r.dbs[key] = &sharedDB{db: db, refs: 1, connected: !lazy}
+	return db, nil
+}
+
+// find returns the pool db belongs to, sessions of a pool share its sql.DB.
+func (r *dbRegistry) find(db *gorm.DB) *sharedDB {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil
+	}
+	for _, s := range r.dbs {
+		if other, err := s.db.DB(); err == nil && other == sqlDB {
+			return s
+		}
+	}
+	return nil
+}
+
+// Connected reports whether the pool of db reached the database before.
+func (r *dbRegistry) Connected(db *gorm.DB) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.find(db)
+	return s != nil && s.connected
+}
+
+// SetConnected records that the pool of db reached the database.
+func (r *dbRegistry) SetConnected(db *gorm.DB) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.find(db); s != nil {
+		s.connected = true
+	}
+}
+
+// Release drops a reference to the pool of db, the last one closes it.
+func (r *dbRegistry) Release(db *gorm.DB) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, s := range r.dbs {
+		if s.db != db {
+			continue
+		}
+		s.refs--
+		if s.refs > 0 {
+			return nil
+		}
+		delete(r.dbs, key)
+		sqlDB, err := db.DB()
+		if err != nil {
+			return err
+		}
+		return sqlDB.Close()
+	}
+	return nil
+}
+
+// connector connects to the database in the background for lazy-connect, retrying with
+// exponential backoff, and runs the setup actions such as auto-migrate once it is reachable.
+type connector struct {
+	db      *gorm.DB
+	actions []func(db *gorm.DB) error
+	// fall passes queries to the next plugin while not connected.
+	fall      bool
+	connected atomic.Bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newConnector returns a connector which starts out connected when the shared pool of db already
+// reached the database, the actions still run in the background.
+func newConnector(db *gorm.DB, actions []func(db *gorm.DB) error, fall bool) *connector {
+	c := &connector{db: db, actions: actions, fall: fall}
+	c.connected.Store(sharedDBs.Connected(db))
+	return c
+}
+
+// Connected reports whether the database may be queried, always true without lazy-connect.
+func (c *connector) Connected() bool {
+	return c == nil || c.connected.Load()
+}
+
+func (c *connector) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	go c.run(ctx)
+	return nil
+}
+
+func (c *connector) Stop() error {
+	if c.cancel == nil {
+		return nil
+	}
+	c.cancel()
+	<-c.done
+	return nil
+}
+
+func (c *connector) run(ctx context.Context) {
+	defer close(c.done)
+	backoff := minConnectBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.connect(ctx)
+		if err == nil {
+			c.connected.Store(true)
+			sharedDBs.SetConnected(c.db)
+			log.Infof("connected to database attempts=%d", attempt)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warningf("connect failed attempt=%d retry=%s error=%q", attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// connect pings the database and runs the actions, they are retried with the ping on failure.
+func (c *connector) connect(ctx context.Context) error {
+	sqlDB, err := c.db.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return err
+	}
+	for _, action := range c.actions {
+		if err := action(c.db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package pdsql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+func TestSharedDBs(t *testing.T) {
+	dsn := "file:shared?mode=memory&cache=shared"
+	a, err := sharedDBs.Acquire("sqlite3", dsn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := sharedDBs.Acquire("sqlite", dsn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatal("Expected the same pool for the same dialect and dsn")
+	}
+
+	sqlDB, err := a.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sharedDBs.Release(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlDB.Ping(); err != nil {
+		t.Fatalf("Expected pool to stay open while referenced, but got %v", err)
+	}
+	if err := sharedDBs.Release(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlDB.Ping(); err == nil {
+		t.Fatal("Expected pool to be closed after the last release")
+	}
+
+	c, err := sharedDBs.Acquire("sqlite3", dsn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharedDBs.Release(c)
+	if c == a {
+		t.Fatal("Expected a new pool after the old one was closed")
+	}
+}
+
+func TestSetupReleasesOnError(t *testing.T) {
+	dsn := "file:setup-error?mode=memory&cache=shared"
+	c := caddy.NewTestController("dns", `pdsql sqlite3 `+dsn+` {
+unknown
+}`)
+	if err := setup(c); err == nil {
+		t.Fatal("Expected errors, but got none")
+	}
+	sharedDBs.mu.Lock()
+	n := len(sharedDBs.dbs)
+	_, ok := sharedDBs.dbs[dbKey{dialect: "sqlite", dsn: dsn}]
+	sharedDBs.mu.Unlock()
+	if ok {
+		t.Fatalf("Expected the pool to be released after a failed setup, %d pools open", n)
+	}
+
+}
+
+func TestConnector(t *testing.T) {
+	db, err := sharedDBs.Acquire("sqlite3", "file:lazy?mode=memory&cache=shared", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharedDBs.Release(db)
+
+	p := PowerDNSGenericSQLBackend{DB: db, Next: test.NextHandler(dns.RcodeRefused, nil)}
+	p.conn = newConnector(db, []func(*gorm.DB) error{
+		func(db *gorm.DB) error { return PowerDNSGenericSQLBackend{DB: db}.AutoMigrate() },
+	}, false)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if code, err := p.ServeDNS(context.TODO(), rec, req); err != ErrNotConnected || code != dns.RcodeServerFailure {
+		t.Fatalf("Expected SERVFAIL before connecting, but got code %d err %v", code, err)
+	}
+	p.conn.fall = true
+	if code, _ := p.ServeDNS(context.TODO(), rec, req); code != dns.RcodeRefused {
+		t.Fatalf("Expected fall through before connecting, but got code %d", code)
+	}
+
+	if err := p.conn.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.conn.Stop()
+	for i := 0; !p.conn.Connected(); i++ {
+		if i == 100 {
+			t.Fatal("Expected to connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !db.Migrator().HasTable(&pdnsmodel.Record{}) {
+		t.Fatal("Expected auto-migrate to run after connecting")
+	}
+
+	// a reload shares the pool, the new instance is connected right away
+	reloaded, err := sharedDBs.Acquire("sqlite3", "file:lazy?mode=memory&cache=shared", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharedDBs.Release(reloaded)
+	if conn := newConnector(reloaded.Debug(), nil, false); !conn.Connected() {
+		t.Error("Expected a connector on a connected pool to start connected")
+	}
+}
@@ -0,0 +1,82 @@
+package pdsql
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+func TestServeDNAME(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{DB: db}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	domain := &pdnsmodel.Domain{Name: "example.org", Type: "NATIVE"}
+	if err := db.Create(domain).Error; err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + "." + strings.Repeat("c", 60) + ".example.org"
+	for _, r := range []pdnsmodel.Record{
+		{DomainId: domain.ID, Name: "old.example.org", Type: "DNAME", Content: "new.example.org", Ttl: 300},
+		{DomainId: domain.ID, Name: "host.old.example.org", Type: "A", Content: "192.168.1.9", Ttl: 3600},
+		{DomainId: domain.ID, Name: "host.new.example.org", Type: "A", Content: "192.168.1.1", Ttl: 3600},
+		{DomainId: domain.ID, Name: "long.example.org", Type: "DNAME", Content: long, Ttl: 300},
+		{DomainId: domain.ID, Name: "*.example.org", Type: "A", Content: "192.168.1.2", Ttl: 3600},
+	} {
+		if err := db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := func(name string, qtype uint16) (int, *dns.Msg) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		code, err := p.ServeDNS(context.TODO(), rec, req)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, but got %v", name, err)
+		}
+		return code, rec.Msg
+	}
+
+	_, msg := query("host.old.example.org.", dns.TypeA)
+	if len(msg.Answer) != 3 {
+		t.Fatalf("Expected DNAME, CNAME and A, but got %v", msg.Answer)
+	}
+	if dname, ok := msg.Answer[0].(*dns.DNAME); !ok || dname.Hdr.Name != "old.example.org." || dname.Target != "new.example.org." {
+		t.Errorf("Expected DNAME old.example.org. -> new.example.org., but got %v", msg.Answer[0])
+	}
+	if cname, ok := msg.Answer[1].(*dns.CNAME); !ok || cname.Hdr.Name != "host.old.example.org." || cname.Target != "host.new.example.org." || cname.Hdr.Ttl != 300 {
+		t.Errorf("Expected CNAME host.old.example.org. -> host.new.example.org., but got %v", msg.Answer[1])
+	}
+	if a, ok := msg.Answer[2].(*dns.A); !ok || a.A.String() != "192.168.1.1" {
+		t.Errorf("Expected the A record of host.new.example.org., but got %v", msg.Answer[2])
+	}
+
+	if _, msg = query("old.example.org.", dns.TypeDNAME); len(msg.Answer) != 1 || msg.Answer[0].Header().Rrtype != dns.TypeDNAME {
+		t.Errorf("Expected the DNAME at its owner, but got %v", msg.Answer)
+	}
+
+	code, msg := query(strings.Repeat("d", 60)+".long.example.org.", dns.TypeA)
+	if code != dns.RcodeSuccess || msg.Rcode != dns.RcodeYXDomain || len(msg.Answer) != 1 {
+		t.Errorf("Expected YXDOMAIN with the DNAME, but got %v", msg)
+	}
+
+	// the default templates follow DNAME records too
+	p.queries = DefaultQueries()
+	if _, msg = query("host.old.example.org.", dns.TypeA); len(msg.Answer) != 3 || msg.Answer[2].(*dns.A).A.String() != "192.168.1.1" {
+		t.Errorf("Expected DNAME, CNAME and A with templates, but got %v", msg.Answer)
+	}
+}
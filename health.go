@@ -0,0 +1,172 @@
+package pdsql
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	healthTimeout         = 5 * time.Second
+)
+
+var (
+	errNotChecked    = errors.New("database not checked yet")
+	errMissingSchema = errors.New("database has no domains or records table")
+)
+
+// Ready implements the ready.Readiness interface, pdsql is ready once the database answered
+// a ping and has the PowerDNS schema.
+func (pdb PowerDNSGenericSQLBackend) Ready() bool {
+	if pdb.health == nil {
+		return checkDatabase(context.Background(), pdb.DB) == nil
+	}
+	return pdb.health.Err() == nil
+}
+
+// checkDatabase pings the database and checks the domains and records tables exist.
+func checkDatabase(ctx context.Context, db *gorm.DB) error {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return err
+	}
+	m := db.WithContext(ctx).Migrator()
+	if !m.HasTable(&pdnsmodel.Domain{}) || !m.HasTable(&pdnsmodel.Record{}) {
+		return errMissingSchema
+	}
+	return nil
+}
+
+// healthProbe checks the database every interval, the result drives Ready and the
+// optional HTTP health endpoint.
+type healthProbe struct {
+	db       *gorm.DB
+	interval time.Duration
+	addr     string
+
+	mu  sync.RWMutex
+	err error
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	ln     net.Listener
+	srv    *http.Server
+}
+
+func newHealthProbe(db *gorm.DB, interval time.Duration, addr string) *healthProbe {
+	return &healthProbe{db: db, interval: interval, addr: addr, err: errNotChecked}
+}
+
+// Err returns the result of the last check.
+func (h *healthProbe) Err() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.err
+}
+
+// Check runs one check and remembers the result.
+func (h *healthProbe) Check(ctx context.Context) error {
+	err := checkDatabase(ctx, h.db)
+	h.mu.Lock()
+	prev := h.err
+	h.err = err
+	h.mu.Unlock()
+
+	switch {
+	case err != nil && (prev == nil || prev == errNotChecked):
+		log.Warningf("database unhealthy error=%q", err)
+	case err == nil && prev != nil && prev != errNotChecked:
+		log.Infof("database healthy again")
+	}
+	return err
+}
+
+func (h *healthProbe) Start() error {
+	if err := h.Listen(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.done = make(chan struct{})
+	go h.run(ctx)
+	return nil
+}
+
+func (h *healthProbe) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+		<-h.done
+	}
+	return h.Close()
+}
+
+// Listen serves the health endpoint on the address, if one is set.
+func (h *healthProbe) Listen() error {
+	if h.addr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", h.addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /health", h)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	h.ln, h.srv = ln, srv
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+			log.Errorf("health server failed addr=%s error=%q", h.addr, err)
+		}
+	}()
+	return nil
+}
+
+// Close stops serving the health endpoint, it is also called before a reload so the new
+// instance can bind the address.
+func (h *healthProbe) Close() error {
+	if h.srv == nil {
+		return nil
+	}
+	ln, srv := h.ln, h.srv
+	h.ln, h.srv = nil, nil
+	// the listener is closed too in case Serve did not take it yet
+	ln.Close()
+	return srv.Close()
+}
+
+func (h *healthProbe) run(ctx context.Context) {
+	defer close(h.done)
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ServeHTTP answers 200 OK while the last check succeeded and 503 with the error otherwise.
+func (h *healthProbe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,112 @@
+package pdsql
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestReady(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{DB: db}
+	if p.Ready() {
+		t.Fatal("Expected not ready without schema")
+	}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Ready() {
+		t.Fatal("Expected ready after migration")
+	}
+
+	p.health = newHealthProbe(db, time.Minute, "")
+	if p.Ready() {
+		t.Fatal("Expected not ready before the first check")
+	}
+	if err := p.health.Check(context.Background()); err != nil {
+		t.Fatalf("Expected healthy database, but got %v", err)
+	}
+	if !p.Ready() {
+		t.Fatal("Expected ready after a successful check")
+	}
+}
+
+func TestHealthProbe(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHealthProbe(db, time.Minute, "")
+	if err := h.Check(context.Background()); err != errMissingSchema {
+		t.Fatalf("Expected missing schema, but got %v", err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503, but got %d", rec.Code)
+	}
+
+	if err := (PowerDNSGenericSQLBackend{DB: db}).AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Check(context.Background()); err != nil {
+		t.Fatalf("Expected healthy database, but got %v", err)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "OK" {
+		t.Fatalf("Expected 200 OK, but got %d %q", rec.Code, rec.Body.String())
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+	if err := h.Check(context.Background()); err == nil {
+		t.Fatal("Expected error after the database was closed")
+	}
+}
+
+func TestHealthProbeRestart(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	old := newHealthProbe(db, time.Hour, addr)
+	if err := old.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer old.Stop()
+	// a reload closes the old listener before the new instance starts
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newHealthProbe(db, time.Hour, addr)
+	if err := reloaded.Start(); err != nil {
+		t.Fatalf("Expected the new instance to bind %s, but got %v", addr, err)
+	}
+	if err := reloaded.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	// a failed reload listens on the address again
+	if err := old.Listen(); err != nil {
+		t.Fatalf("Expected the old instance to bind %s again, but got %v", addr, err)
+	}
+}
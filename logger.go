@@ -0,0 +1,67 @@
+package pdsql
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var log = clog.NewWithPlugin(Name)
+
+// slowQueryThreshold is the duration above which statements are logged as warnings.
+const slowQueryThreshold = 200 * time.Millisecond
+
+// gormLogger routes the gorm log through the CoreDNS log, statements are logged at info
+// level once the level is raised to logger.Info by `debug db`.
+type gormLogger struct {
+	level logger.LogLevel
+}
+
+func newGormLogger() logger.Interface {
+	return gormLogger{level: logger.Warn}
+}
+
+func (l gormLogger) LogMode(level logger.LogLevel) logger.Interface {
+	l.level = level
+	return l
+}
+
+func (l gormLogger) Info(_ context.Context, format string, args ...interface{}) {
+	if l.level >= logger.Info {
+		log.Infof(format, args...)
+	}
+}
+
+func (l gormLogger) Warn(_ context.Context, format string, args ...interface{}) {
+	if l.level >= logger.Warn {
+		log.Warningf(format, args...)
+	}
+}
+
+func (l gormLogger) Error(_ context.Context, format string, args ...interface{}) {
+	if l.level >= logger.Error {
+		log.Errorf(format, args...)
+	}
+}
+
+func (l gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.level <= logger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && l.level >= logger.Error && !errors.Is(err, gorm.ErrRecordNotFound):
+		sql, rows := fc()
+		log.Errorf("sql kind=%s rows=%d duration=%s error=%q sql=%q", kindFrom(ctx), rows, elapsed, err, sql)
+	case elapsed > slowQueryThreshold && l.level >= logger.Warn:
+		sql, rows := fc()
+		log.Warningf("slow sql kind=%s rows=%d duration=%s sql=%q", kindFrom(ctx), rows, elapsed, sql)
+	case l.level >= logger.Info:
+		sql, rows := fc()
+		log.Infof("sql kind=%s rows=%d duration=%s sql=%q", kindFrom(ctx), rows, elapsed, sql)
+	}
+}
@@ -0,0 +1,276 @@
+package pdsql
+
+import (
+	"strings"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/miekg/dns"
+	otext "github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+)
+
+// maxChainLength limits the number of CNAME hops followed for one query.
+const maxChainLength = 8
+
+const lookupQuery = `SELECT id, domain_id, name, type, content, ttl, prio, 0 AS zone FROM records
+WHERE disabled = ? AND (name = ? OR name IN ? OR (type = 'DNAME' AND name IN ?))
+UNION ALL
+SELECT id, id AS domain_id, name, type, '' AS content, 0 AS ttl, 0 AS prio, 1 AS zone FROM domains
+WHERE name IN ?`
+
+// lookupRow is a row of the lookup query, Zone marks rows coming from the domains table.
+type lookupRow struct {
+	pdnsmodel.Record `gorm:"embedded"`
+	Zone             int
+}
+
+// lookupResult holds everything known about a name after a single lookup query.
+type lookupResult struct {
+	name     string
+	exact    []*pdnsmodel.Record
+	wildcard []*pdnsmodel.Record
+	domain   *pdnsmodel.Domain
+	// dname is the closest DNAME above the name, it occludes the records of the name.
+	dname *pdnsmodel.Record
+}
+
+// lookupStats describes how a lookup found its answer.
+type lookupStats struct {
+	// chain is the number of CNAME hops followed.
+	chain    int
+	wildcard bool
+	// domainID is the domain the queried name was found in.
+	domainID uint
+	// yxdomain is set when a DNAME substitution made the name too long.
+	yxdomain bool
+}
+
+// Lookup resolves the records answering qname and qtype, following CNAME chains and wildcards.
+// A query for a name without CNAME needs a single SQL statement, every CNAME hop adds one.
+func (pdb PowerDNSGenericSQLBackend) Lookup(qname string, qtype uint16) ([]*pdnsmodel.Record, error) {
+	answer, _, err := pdb.lookup(qname, qtype)
+	return answer, err
+}
+
+func (pdb PowerDNSGenericSQLBackend) lookup(qname string, qtype uint16) ([]*pdnsmodel.Record, lookupStats, error) {
+	var answer []*pdnsmodel.Record
+	var stats lookupStats
+	seen := map[string]bool{}
+
+	name := qname
+	for hop := 0; hop <= maxChainLength; hop++ {
+		res, err := pdb.tracedLookupName(name, qtype, hop)
+		if err != nil {
+			return nil, stats, err
+		}
+		seen[res.name] = true
+		if hop == 0 {
+			stats.domainID = res.domainID()
+		}
+
+		if res.dname != nil {
+			cname, ok := synthesizeCNAME(res.name, res.dname)
+			answer = append(answer, res.dname)
+			if !ok {
+				stats.yxdomain = true
+				break
+			}
+			answer = append(answer, cname)
+			if qtype == dns.TypeANY || seen[normalizeName(cname.Content)] {
+				break
+			}
+			name = cname.Content
+			stats.chain++
+			continue
+		}
+
+		records := res.exact
+		if len(records) == 0 && len(res.wildcard) != 0 {
+			records = res.wildcard
+			stats.wildcard = true
+		}
+		records = filterType(records, qtype)
+		answer = append(answer, records...)
+
+		if qtype == dns.TypeANY {
+			break
+		}
+		target := ""
+		for _, r := range records {
+			if r.Type == "CNAME" {
+				target = r.Content
+			}
+		}
+		if target == "" || seen[normalizeName(target)] {
+			break
+		}
+		name = target
+		stats.chain++
+	}
+
+	return answer, stats, nil
+}
+
+// tracedLookupName runs lookupName in a span when the request is traced, the first hop is
+// the lookup of the queried name and every following one a CNAME target.
+func (pdb PowerDNSGenericSQLBackend) tracedLookupName(name string, qtype uint16, hop int) (*lookupResult, error) {
+	op := "lookup"
+	if hop > 0 {
+		op = "cname"
+	}
+	span, ctx := startSpan(pdb.DB.Statement.Context, op)
+	if span == nil {
+		return pdb.lookupName(name, qtype)
+	}
+	defer span.Finish()
+
+	pdb.DB = pdb.DB.WithContext(ctx)
+	res, err := pdb.lookupName(name, qtype)
+	span.SetTag("pdsql.name", name)
+	span.SetTag("pdsql.qtype", dns.TypeToString[qtype])
+	if err != nil {
+		otext.Error.Set(span, true)
+		span.LogFields(otlog.Error(err))
+		return nil, err
+	}
+	span.SetTag("pdsql.rows", len(res.exact)+len(res.wildcard))
+	span.SetTag("pdsql.wildcard", len(res.exact) == 0 && len(res.wildcard) != 0)
+	if res.domain != nil {
+		span.SetTag("pdsql.domain", res.domain.Name)
+	}
+	return res, nil
+}
+
+// lookupName fetches the rows owned by name, the wildcards which may cover it and the
+// candidate zones containing it in a single statement.
+func (pdb PowerDNSGenericSQLBackend) lookupName(qname string, qtype uint16) (*lookupResult, error) {
+	name := normalizeName(qname)
+	res := &lookupResult{name: name}
+
+	zones, wildcards := candidateNames(name)
+	if len(zones) == 0 {
+		return res, nil
+	}
+	if pdb.queries != nil {
+		return pdb.lookupTemplates(res, qtype, zones, wildcards)
+	}
+	if len(wildcards) == 0 {
+		// keep the IN list valid
+		wildcards = []string{name}
+	}
+
+	var rows []lookupRow
+	if err := withKind(pdb.DB, "lookup").Raw(lookupQuery, false, name, wildcards, zones, zones).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	var candidates, dnames []*pdnsmodel.Record
+	for i := range rows {
+		row := &rows[i]
+		switch {
+		case row.Zone == 1:
+			if res.domain == nil || len(row.Name) > len(res.domain.Name) {
+				res.domain = &pdnsmodel.Domain{ID: row.ID, Name: row.Name, Type: row.Type}
+			}
+		case row.Name == name:
+			res.exact = append(res.exact, &row.Record)
+		case row.Type == "DNAME":
+			dnames = append(dnames, &row.Record)
+		default:
+			candidates = append(candidates, &row.Record)
+		}
+	}
+
+	if res.pickDNAME(dnames); res.dname != nil {
+		res.exact = nil
+		return res, nil
+	}
+	if len(res.exact) == 0 && res.domain != nil {
+		res.pickWildcard(candidates)
+	}
+	return res, nil
+}
+
+// pickDNAME keeps the closest DNAME above the name, inside the zone of the name when it is known.
+func (res *lookupResult) pickDNAME(dnames []*pdnsmodel.Record) {
+	for _, r := range dnames {
+		if res.domain != nil && (r.DomainId != res.domain.ID || len(r.Name) < len(res.domain.Name)) {
+			continue
+		}
+		if res.dname == nil || len(r.Name) > len(res.dname.Name) {
+			res.dname = r
+		}
+	}
+}
+
+// synthesizeCNAME returns the CNAME RFC 6672 synthesizes for name below the owner of dname,
+// it reports false when the substituted name is longer than a domain name can be.
+func synthesizeCNAME(name string, dname *pdnsmodel.Record) (*pdnsmodel.Record, bool) {
+	target := strings.TrimSuffix(name, dname.Name) + normalizeName(dname.Content)
+	if _, ok := dns.IsDomainName(dns.Fqdn(target)); !ok || len(dns.Fqdn(target)) > 254 {
+		return nil, false
+	}
+	return &pdnsmodel.Record{DomainId: dname.DomainId, Name: name, Type: "CNAME", Content: target, Ttl: dname.Ttl}, true
+}
+
+// domainID returns the id of the domain the rows were found in, 0 when unknown.
+func (res *lookupResult) domainID() uint {
+	if res.domain != nil {
+		return res.domain.ID
+	}
+	if len(res.exact) != 0 {
+		return res.exact[0].DomainId
+	}
+	return 0
+}
+
+// pickWildcard keeps the records of the closest wildcard inside the zone, renamed to the queried name.
+func (res *lookupResult) pickWildcard(candidates []*pdnsmodel.Record) {
+	closest := ""
+	for _, r := range candidates {
+		if r.DomainId == res.domain.ID && len(r.Name) > len(closest) && WildcardMatch(res.name, r.Name) {
+			closest = r.Name
+		}
+	}
+	for _, r := range candidates {
+		if r.DomainId == res.domain.ID && r.Name == closest {
+			r.Name = res.name
+			res.wildcard = append(res.wildcard, r)
+		}
+	}
+}
+
+// candidateNames returns the zones which may contain name, longest first,
+// and the wildcard names which may cover it.
+func candidateNames(name string) (zones, wildcards []string) {
+	labels := dns.SplitDomainName(name)
+	for i := range labels {
+		zones = append(zones, strings.Join(labels[i:], "."))
+		if i > 0 {
+			wildcards = append(wildcards, "*."+strings.Join(labels[i:], "."))
+		}
+	}
+	return zones, wildcards
+}
+
+// filterType keeps the records answering qtype, CNAME records answer every type and ALIAS records A and AAAA.
+// LUA records are kept for every type, the type they answer is part of their content.
+func filterType(records []*pdnsmodel.Record, qtype uint16) []*pdnsmodel.Record {
+	if qtype == dns.TypeANY {
+		return records
+	}
+	t := dns.TypeToString[qtype]
+	var out []*pdnsmodel.Record
+	for _, r := range records {
+		if r.Type == t || r.Type == "CNAME" || r.Type == "LUA" || r.Type == "ALIAS" && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// normalizeName converts a dns name to the form stored in the records table.
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
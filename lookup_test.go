@@ -0,0 +1,133 @@
+package pdsql_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pdsql "github.com/wenerme/coredns-pdsql"
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// statementCounter counts the SQL statements executed through gorm.
+type statementCounter struct {
+	logger.Interface
+	n int64
+}
+
+func (c *statementCounter) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	atomic.AddInt64(&c.n, 1)
+}
+
+func newLookupBackend(tb testing.TB, path string) (pdsql.PowerDNSGenericSQLBackend, *statementCounter) {
+	counter := &statementCounter{Interface: logger.Default.LogMode(logger.Silent)}
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: counter})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	p := pdsql.PowerDNSGenericSQLBackend{DB: db}
+	if err := p.AutoMigrate(); err != nil {
+		tb.Fatal(err)
+	}
+
+	domain := &pdnsmodel.Domain{Name: "example.org", Type: "NATIVE"}
+	if err := p.DB.Create(domain).Error; err != nil {
+		tb.Fatal(err)
+	}
+	records := []pdnsmodel.Record{
+		{Name: "example.org", DomainId: domain.ID, Type: "A", Content: "192.168.1.1", Ttl: 3600},
+		{Name: "*.example.org", DomainId: domain.ID, Type: "A", Content: "192.168.1.2", Ttl: 3600},
+		{Name: "*.sub.example.org", DomainId: domain.ID, Type: "A", Content: "192.168.1.3", Ttl: 3600},
+		{Name: "*.sub.example.org", DomainId: domain.ID, Type: "TXT", Content: "sub", Ttl: 3600},
+		{Name: "cname.example.org", DomainId: domain.ID, Type: "CNAME", Content: "a.sub.example.org", Ttl: 3600},
+		{Name: "loop1.example.org", DomainId: domain.ID, Type: "CNAME", Content: "loop2.example.org", Ttl: 3600},
+		{Name: "loop2.example.org", DomainId: domain.ID, Type: "CNAME", Content: "loop1.example.org", Ttl: 3600},
+	}
+	for i := 0; i < 1000; i++ {
+		records = append(records, pdnsmodel.Record{Name: fmt.Sprintf("host%d.example.org", i), DomainId: domain.ID, Type: "A", Content: "10.0.0.1", Ttl: 3600})
+	}
+	if err := p.DB.CreateInBatches(records, 100).Error; err != nil {
+		tb.Fatal(err)
+	}
+	atomic.StoreInt64(&counter.n, 0)
+	return p, counter
+}
+
+func TestLookup(t *testing.T) {
+	p, counter := newLookupBackend(t, ":memory:")
+
+	tests := []struct {
+		qname      string
+		qtype      uint16
+		statements int64
+		expected   []string
+	}{
+		{"host1.example.org.", dns.TypeA, 1, []string{"host1.example.org A 10.0.0.1"}},
+		{"Host1.Example.ORG.", dns.TypeA, 1, []string{"host1.example.org A 10.0.0.1"}},
+		{"host1.example.org.", dns.TypeTXT, 1, nil},
+		{"x.example.org.", dns.TypeA, 1, []string{"x.example.org A 192.168.1.2"}},
+		{"x.y.sub.example.org.", dns.TypeA, 1, []string{"x.y.sub.example.org A 192.168.1.3"}},
+		{"x.sub.example.org.", dns.TypeMX, 1, nil},
+		{"x.sub.example.org.", dns.TypeANY, 1, []string{"x.sub.example.org A 192.168.1.3", "x.sub.example.org TXT sub"}},
+		{"cname.example.org.", dns.TypeA, 2, []string{"cname.example.org CNAME a.sub.example.org", "a.sub.example.org A 192.168.1.3"}},
+		{"loop1.example.org.", dns.TypeA, 2, []string{"loop1.example.org CNAME loop2.example.org", "loop2.example.org CNAME loop1.example.org"}},
+		{"example.net.", dns.TypeA, 1, nil},
+	}
+
+	for _, tc := range tests {
+		atomic.StoreInt64(&counter.n, 0)
+		records, err := p.Lookup(tc.qname, tc.qtype)
+		if err != nil {
+			t.Fatalf("Lookup %s: %v", tc.qname, err)
+		}
+		var actual []string
+		for _, r := range records {
+			actual = append(actual, fmt.Sprintf("%s %s %s", r.Name, r.Type, r.Content))
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(tc.expected) {
+			t.Errorf("Lookup %s %s: Expected %v, but got %v", tc.qname, dns.TypeToString[tc.qtype], tc.expected, actual)
+		}
+		if n := atomic.LoadInt64(&counter.n); n != tc.statements {
+			t.Errorf("Lookup %s %s: Expected %d statements, but got %d", tc.qname, dns.TypeToString[tc.qtype], tc.statements, n)
+		}
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	p, _ := newLookupBackend(b, b.TempDir()+"/bench.db")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Lookup("host500.example.org.", dns.TypeA); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := p.Lookup("x.sub.example.org.", dns.TypeA); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkLookupSequential measures the former lookup path, exact name then wildcard search.
+func BenchmarkLookupSequential(b *testing.B) {
+	p, _ := newLookupBackend(b, b.TempDir()+"/bench.db")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, qname := range []string{"host500.example.org.", "x.sub.example.org."} {
+			records, err := p.ResolveRequest(qname, dns.TypeA)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(records) == 0 {
+				if _, err := p.SearchWildcard(qname, dns.TypeA); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package pdsql
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"golang.org/x/net/context"
+)
+
+// TypeLUA is the type PowerDNS uses for LUA records in zone transfers.
+const TypeLUA uint16 = 65402
+
+const (
+	// luaTimeout limits the run time of one LUA record.
+	luaTimeout = 100 * time.Millisecond
+	// luaMaxString limits the strings built by string.rep.
+	luaMaxString = 1 << 16
+)
+
+// luaRequest is what a LUA record knows about the query it answers.
+type luaRequest struct {
+	qname string
+	// who is the address of the client, bestwho the EDNS client subnet address when the query has one.
+	who     net.IP
+	bestwho net.IP
+	checker *targetChecker
+}
+
+func newLuaRequest(state request.Request, checker *targetChecker) *luaRequest {
+	req := &luaRequest{qname: state.QName(), who: net.ParseIP(state.IP()), checker: checker}
+	req.bestwho = req.who
+	if opt := state.Req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok && subnet.Address != nil {
+				req.bestwho = subnet.Address
+			}
+		}
+	}
+	return req
+}
+
+// expandLUA evaluates a PowerDNS LUA record, its content is the type of the records it produces
+// followed by a Lua expression, or a block of statements when it starts with a semicolon.
+// Records of other types than qtype are skipped, errors are reported as malformed records.
+func (pdb PowerDNSGenericSQLBackend) expandLUA(ctx context.Context, state request.Request, v *pdnsmodel.Record) ([]dns.RR, error) {
+	typ, script, err := luaScript(v)
+	if err != nil {
+		return nil, err
+	}
+	if state.QType() != dns.TypeANY && dns.TypeToString[state.QType()] != typ {
+		return nil, nil
+	}
+
+	values, err := evalLUA(ctx, newLuaRequest(state, pdb.checker), luaChunk(script))
+	if err != nil {
+		return nil, malformed(v, "lua: %v", err)
+	}
+	var rrs []dns.RR
+	for _, content := range values {
+		rr, err := ToRR(&pdnsmodel.Record{ID: v.ID, DomainId: v.DomainId, Name: v.Name, Type: typ, Content: content, Ttl: v.Ttl, Prio: v.Prio}, dns.ClassINET)
+		if err != nil {
+			return nil, err
+		}
+		if rr != nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, nil
+}
+
+// luaScript splits the content of a LUA record into the type of its answer and its script.
+func luaScript(v *pdnsmodel.Record) (string, string, error) {
+	typ, script, _ := strings.Cut(strings.TrimSpace(v.Content), " ")
+	typ = strings.ToUpper(typ)
+	if _, ok := dns.StringToType[typ]; !ok || typ == "LUA" {
+		return "", "", malformed(v, "invalid LUA record type: %s", typ)
+	}
+	script = strings.TrimSpace(script)
+	if s, err := strconv.Unquote(script); err == nil {
+		script = s
+	}
+	return typ, script, nil
+}
+
+// luaChunk returns the Lua code running script, a block of statements when it starts with a
+// semicolon and an expression otherwise.
+func luaChunk(script string) string {
+	if strings.HasPrefix(script, ";") {
+		return script[1:]
+	}
+	return "return " + script
+}
+
+// luaRR converts a LUA row to the TYPE65402 record PowerDNS transfers it as, the type of the
+// answer followed by the script. Scripts which do not compile are malformed.
+func luaRR(v *pdnsmodel.Record, class uint16) (dns.RR, error) {
+	typ, script, err := luaScript(v)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(strings.NewReader(luaChunk(script)), v.Name)
+	if err == nil {
+		_, err = lua.Compile(chunk, v.Name)
+	}
+	if err != nil {
+		return nil, malformed(v, "lua: %v", err)
+	}
+	rdata := make([]byte, 2, 2+len(script))
+	binary.BigEndian.PutUint16(rdata, dns.StringToType[typ])
+	return &dns.RFC3597{
+		Hdr:   dns.RR_Header{Name: dns.Fqdn(v.Name), Rrtype: TypeLUA, Class: class, Ttl: v.Ttl},
+		Rdata: hex.EncodeToString(append(rdata, script...)),
+	}, nil
+}
+
+// luaContent returns the content of the LUA row a TYPE65402 record is stored as.
+func luaContent(rr *dns.RFC3597) (string, error) {
+	buf, err := hex.DecodeString(rr.Rdata)
+	if err != nil {
+		return "", err
+	}
+	if len(buf) < 2 {
+		return "", errors.New("LUA record without type")
+	}
+	typ, ok := dns.TypeToString[binary.BigEndian.Uint16(buf)]
+	if !ok {
+		return "", fmt.Errorf("unknown LUA record type %d", binary.BigEndian.Uint16(buf))
+	}
+	return typ + " " + strconv.Quote(string(buf[2:])), nil
+}
+
+// evalLUA runs code in a sandbox with the base, string, table and math libraries and
+// the PowerDNS record functions, it returns the record contents the code returned.
+func evalLUA(ctx context.Context, req *luaRequest, code string) ([]string, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "module", "require", "collectgarbage"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	// the time limit does not stop a single large allocation
+	L.GetGlobal(lua.StringLibName).(*lua.LTable).RawSetString("rep", L.NewFunction(luaStringRep))
+
+	L.SetGlobal("qname", lua.LString(req.qname))
+	L.SetGlobal("who", lua.LString(req.who.String()))
+	L.SetGlobal("bestwho", lua.LString(req.bestwho.String()))
+	for name, fn := range map[string]func(*lua.LState, *luaRequest) int{
+		"pickrandom":    luaPickRandom,
+		"pickwrandom":   luaPickWRandom,
+		"pickwhashed":   luaPickWHashed,
+		"ifportup":      luaIfPortUp,
+		"ifurlup":       luaIfURLUp,
+		"view":          luaView,
+		"createReverse": luaCreateReverse,
+	} {
+		L.SetGlobal(name, L.NewFunction(func(L *lua.LState) int { return fn(L, req) }))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, luaTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	if err := L.DoString(code); err != nil {
+		return nil, err
+	}
+	return luaStrings(L.Get(-1)), nil
+}
+
+// luaStringRep implements string.rep(s, n) for results up to luaMaxString bytes.
+func luaStringRep(L *lua.LState) int {
+	s := L.CheckString(1)
+	n := L.CheckInt(2)
+	if n > 0 && len(s) > luaMaxString/n {
+		L.RaiseError("string.rep result longer than %d bytes", luaMaxString)
+	}
+	L.Push(lua.LString(strings.Repeat(s, max(n, 0))))
+	return 1
+}
+
+// luaStrings converts a returned string, number or list of them to record contents.
+func luaStrings(v lua.LValue) []string {
+	switch v := v.(type) {
+	case lua.LString, lua.LNumber:
+		return []string{v.String()}
+	case *lua.LTable:
+		var out []string
+		v.ForEach(func(_, value lua.LValue) {
+			out = append(out, luaStrings(value)...)
+		})
+		return out
+	}
+	return nil
+}
+
+// luaWeighted reads a list of {weight, value} pairs.
+func luaWeighted(L *lua.LState, n int) (weights []int, values []string) {
+	L.CheckTable(n).ForEach(func(_, pair lua.LValue) {
+		t, ok := pair.(*lua.LTable)
+		if !ok {
+			L.ArgError(n, "expected {weight, value} pairs")
+		}
+		weight, ok := t.RawGetInt(1).(lua.LNumber)
+		if !ok || weight < 0 {
+			L.ArgError(n, "invalid weight")
+		}
+		weights = append(weights, int(weight))
+		values = append(values, t.RawGetInt(2).String())
+	})
+	if len(values) == 0 {
+		L.ArgError(n, "empty list")
+	}
+	return weights, values
+}
+
+// pickWeighted returns the value the weights map n into, n is below the sum of the weights.
+func pickWeighted(weights []int, values []string, n int) string {
+	for i, w := range weights {
+		if n < w {
+			return values[i]
+		}
+		n -= w
+	}
+	return values[len(values)-1]
+}
+
+func sumWeights(weights []int) int {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	return total
+}
+
+// luaPickRandom implements pickrandom(values), a random value of the list.
+func luaPickRandom(L *lua.LState, _ *luaRequest) int {
+	values := luaStrings(L.CheckTable(1))
+	if len(values) == 0 {
+		L.ArgError(1, "empty list")
+	}
+	L.Push(lua.LString(values[rand.Intn(len(values))]))
+	return 1
+}
+
+// luaPickWRandom implements pickwrandom({{weight, value}, ...}), a random value by weight.
+func luaPickWRandom(L *lua.LState, _ *luaRequest) int {
+	weights, values := luaWeighted(L, 1)
+	n := 0
+	if total := sumWeights(weights); total > 0 {
+		n = rand.Intn(total)
+	}
+	L.Push(lua.LString(pickWeighted(weights, values, n)))
+	return 1
+}
+
+// luaPickWHashed implements pickwhashed({{weight, value}, ...}), a value by weight picked by
+// the hash of the client address so a client keeps getting the same answer.
+func luaPickWHashed(L *lua.LState, req *luaRequest) int {
+	weights, values := luaWeighted(L, 1)
+	n := 0
+	if total := sumWeights(weights); total > 0 {
+		h := fnv.New32a()
+		h.Write(req.bestwho)
+		n = int(h.Sum32() % uint32(total))
+	}
+	L.Push(lua.LString(pickWeighted(weights, values, n)))
+	return 1
+}
+
+// luaSelect applies the selector option of the if*up functions to the available addresses.
+func luaSelect(L *lua.LState, req *luaRequest, selector string, addrs []string) lua.LValue {
+	switch selector {
+	case "", "random":
+		return lua.LString(addrs[rand.Intn(len(addrs))])
+	case "all":
+		t := L.NewTable()
+		for _, a := range addrs {
+			t.Append(lua.LString(a))
+		}
+		return t
+	case "hashed":
+		h := fnv.New32a()
+		h.Write(req.bestwho)
+		return lua.LString(addrs[h.Sum32()%uint32(len(addrs))])
+	}
+	L.RaiseError("unknown selector %q", selector)
+	return nil
+}
+
+// luaOption returns the string option name of the options table at n.
+func luaOption(L *lua.LState, n int, name string) string {
+	if t, ok := L.Get(n).(*lua.LTable); ok {
+		if v := t.RawGetString(name); v != lua.LNil {
+			return v.String()
+		}
+	}
+	return ""
+}
+
+// luaIfUp returns the addresses of groups which are up, the first group with one up wins.
+// When none is up all addresses are returned through the backupSelector.
+func luaIfUp(L *lua.LState, req *luaRequest, n int, up func(addr string) bool) int {
+	var groups [][]string
+	L.CheckTable(n).ForEach(func(_, v lua.LValue) {
+		if t, ok := v.(*lua.LTable); ok {
+			groups = append(groups, luaStrings(t))
+		}
+	})
+	if len(groups) == 0 {
+		groups = [][]string{luaStrings(L.CheckTable(n))}
+	}
+
+	var all []string
+	for _, group := range groups {
+		var available []string
+		for _, addr := range group {
+			if up(addr) {
+				available = append(available, addr)
+			}
+		}
+		if len(available) != 0 {
+			L.Push(luaSelect(L, req, luaOption(L, n+1, "selector"), available))
+			return 1
+		}
+		all = append(all, group...)
+	}
+	if len(all) == 0 {
+		L.ArgError(n, "empty list")
+	}
+	L.Push(luaSelect(L, req, luaOption(L, n+1, "backupSelector"), all))
+	return 1
+}
+
+// luaIfPortUp implements ifportup(port, addresses, options), the addresses accepting TCP connections on port.
+func luaIfPortUp(L *lua.LState, req *luaRequest) int {
+	port := strconv.Itoa(L.CheckInt(1))
+	return luaIfUp(L, req, 2, func(addr string) bool {
+		target := net.JoinHostPort(addr, port)
+		return req.checker.Up("tcp "+target, probeTCP(target))
+	})
+}
+
+// luaIfURLUp implements ifurlup(url, addresses, options), the addresses serving url without an error status.
+func luaIfURLUp(L *lua.LState, req *luaRequest) int {
+	u := L.CheckString(1)
+	return luaIfUp(L, req, 2, func(addr string) bool {
+		return req.checker.Up(fmt.Sprintf("url %s %s", u, addr), probeURL(u, addr))
+	})
+}
+
+// luaView implements view({{{netmasks...}, {values...}}, ...}), the values of the first
+// entry with a netmask containing the client.
+func luaView(L *lua.LState, req *luaRequest) int {
+	var result lua.LValue = lua.LNil
+	L.CheckTable(1).ForEach(func(_, entry lua.LValue) {
+		t, ok := entry.(*lua.LTable)
+		if !ok || result != lua.LNil {
+			return
+		}
+		for _, mask := range luaStrings(t.RawGetInt(1)) {
+			_, network, err := net.ParseCIDR(mask)
+			if err != nil {
+				L.RaiseError("invalid netmask %q", mask)
+			}
+			if network.Contains(req.bestwho) {
+				result = t.RawGetInt(2)
+				return
+			}
+		}
+	})
+	L.Push(result)
+	return 1
+}
+
+// luaCreateReverse implements createReverse(format, exceptions) for in-addr.arpa names, %1% to %4%
+// in format are replaced by the octets of the address and %5% by the address joined with dashes.
+func luaCreateReverse(L *lua.LState, req *luaRequest) int {
+	format := L.CheckString(1)
+	labels := dns.SplitDomainName(strings.ToLower(req.qname))
+	if len(labels) != 6 || labels[4] != "in-addr" || labels[5] != "arpa" {
+		L.RaiseError("createReverse needs an in-addr.arpa name, got %s", req.qname)
+	}
+	octets := []string{labels[3], labels[2], labels[1], labels[0]}
+	ip := strings.Join(octets, ".")
+	if net.ParseIP(ip) == nil {
+		L.RaiseError("invalid address %s", ip)
+	}
+
+	if exceptions, ok := L.Get(2).(*lua.LTable); ok {
+		if v := exceptions.RawGetString(ip); v != lua.LNil {
+			L.Push(v)
+			return 1
+		}
+	}
+	name := format
+	for i, o := range octets {
+		name = strings.ReplaceAll(name, fmt.Sprintf("%%%d%%", i+1), o)
+	}
+	name = strings.ReplaceAll(name, "%5%", strings.Join(octets, "-"))
+	L.Push(lua.LString(name))
+	return 1
+}
@@ -0,0 +1,139 @@
+package pdsql
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+func TestEvalLUA(t *testing.T) {
+	req := &luaRequest{qname: "4.3.2.1.in-addr.arpa.", who: net.ParseIP("10.1.2.3"), bestwho: net.ParseIP("192.168.1.1")}
+
+	tests := []struct {
+		code     string
+		expected []string
+	}{
+		{"return pickrandom({'192.0.2.1'})", []string{"192.0.2.1"}},
+		{"return pickwrandom({{0, '192.0.2.1'}, {10, '192.0.2.2'}})", []string{"192.0.2.2"}},
+		{"return pickwhashed({{0, '192.0.2.1'}, {10, '192.0.2.2'}})", []string{"192.0.2.2"}},
+		{"return view({{{'10.0.0.0/8'}, {'192.0.2.1'}}, {{'0.0.0.0/0'}, {'192.0.2.2', '192.0.2.3'}}})", []string{"192.0.2.2", "192.0.2.3"}},
+		{"return createReverse('ip-%1%-%2%-%3%-%4%.example.org')", []string{"ip-1-2-3-4.example.org"}},
+		{"return createReverse('%5%.example.org', {['1.2.3.4'] = 'gateway.example.org'})", []string{"gateway.example.org"}},
+		{"local a = {'192.0.2.1', '192.0.2.2'} return a", []string{"192.0.2.1", "192.0.2.2"}},
+		{"return who", []string{"10.1.2.3"}},
+		{"return ('192.0.2.1 '):rep(2)", []string{"192.0.2.1 192.0.2.1 "}},
+	}
+	for _, tc := range tests {
+		values, err := evalLUA(context.TODO(), req, tc.code)
+		if err != nil {
+			t.Errorf("%s: Expected no error, but got %v", tc.code, err)
+			continue
+		}
+		if strings.Join(values, " ") != strings.Join(tc.expected, " ") {
+			t.Errorf("%s: Expected %v, but got %v", tc.code, tc.expected, values)
+		}
+	}
+
+	for _, code := range []string{
+		"return pickrandom({})",
+		"return dofile('/etc/passwd')",
+		"return os.exit(1)",
+		"while true do end",
+		"return string.rep('x', 1e9)",
+		"return ('x'):rep(1e9)",
+	} {
+		if _, err := evalLUA(context.TODO(), req, code); err == nil {
+			t.Errorf("%s: Expected an error", code)
+		}
+	}
+}
+
+func TestServeLUA(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	closed, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{DB: db, checker: newTargetChecker(time.Hour, time.Second)}
+	defer p.checker.Stop()
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []pdnsmodel.Record{
+		{Name: "example.org", Type: "LUA", Content: `A "ifportup(` + strconv.Itoa(port) + `, {'127.0.0.1', '127.0.0.2'}, {selector='all'})"`, Ttl: 60},
+		{Name: "example.org", Type: "LUA", Content: `TXT ";return 'hello ' .. qname"`, Ttl: 60},
+		{Name: "bad.example.org", Type: "LUA", Content: `A "nofunction()"`, Ttl: 60},
+	} {
+		if err := db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := p.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatalf("Expected no error for %s, but got %v", name, err)
+		}
+		return rec.Msg
+	}
+	addrs := func(msg *dns.Msg) []string {
+		var out []string
+		for _, rr := range msg.Answer {
+			out = append(out, rr.(*dns.A).A.String())
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	msg := query("example.org.", dns.TypeTXT)
+	if len(msg.Answer) != 1 || msg.Answer[0].(*dns.TXT).Txt[0] != "hello example.org." {
+		t.Errorf("Expected the TXT of the LUA block, but got %v", msg.Answer)
+	}
+	if p.checker.cancel != nil {
+		t.Errorf("Expected no background probes before the first check")
+	}
+
+	// not probed yet, both are up
+	if got := addrs(query("example.org.", dns.TypeA)); len(got) != 2 {
+		t.Fatalf("Expected both addresses before the first probe, but got %v", got)
+	}
+	if p.checker.cancel == nil {
+		t.Errorf("Expected the background probes to start with the first check")
+	}
+	p.checker.CheckAll(context.TODO())
+	if got := addrs(query("example.org.", dns.TypeA)); len(got) != 1 || got[0] != "127.0.0.1" {
+		t.Errorf("Expected only the listening address, but got %v", got)
+	}
+
+	p.Strict = true
+	req := new(dns.Msg)
+	req.SetQuestion("bad.example.org.", dns.TypeA)
+	if code, err := p.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), req); code != dns.RcodeServerFailure || err == nil {
+		t.Errorf("Expected SERVFAIL for a failing LUA record in strict mode, but got code %d err %v", code, err)
+	}
+}
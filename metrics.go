@@ -0,0 +1,286 @@
+package pdsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gorm.io/gorm"
+)
+
+var (
+	// malformedRecordCount is the number of records dropped from answers because of malformed content.
+	malformedRecordCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pdsql",
+		Name:      "malformed_records_total",
+		Help:      "Counter of records dropped from answers because of malformed content.",
+	}, []string{"server", "zone", "type"})
+
+	// queryCount is the number of SQL statements per lookup kind.
+	queryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pdsql",
+		Name:      "sql_queries_total",
+		Help:      "Counter of SQL statements per lookup kind.",
+	}, []string{"server", "zone", "kind"})
+
+	// queryDuration is the latency of SQL statements per lookup kind.
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pdsql",
+		Name:      "sql_query_duration_seconds",
+		Buckets:   plugin.TimeBuckets,
+		Help:      "Histogram of the time SQL statements took.",
+	}, []string{"server", "zone", "kind"})
+
+	// dbErrorCount is the number of failed database operations by class.
+	dbErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pdsql",
+		Name:      "db_errors_total",
+		Help:      "Counter of database errors by class: connection, timeout, breaker or query.",
+	}, []string{"server", "zone", "class"})
+
+	// responseCount is the number of answers written by pdsql per rcode.
+	responseCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pdsql",
+		Name:      "responses_total",
+		Help:      "Counter of responses answered by pdsql per rcode.",
+	}, []string{"server", "zone", "rcode"})
+
+	// wildcardHitCount is the number of lookups answered by a wildcard record.
+	wildcardHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pdsql",
+		Name:      "wildcard_hits_total",
+		Help:      "Counter of lookups answered by a wildcard record.",
+	}, []string{"server", "zone"})
+
+	// cnameChainLength is the number of CNAME hops followed per lookup.
+	cnameChainLength = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pdsql",
+		Name:      "cname_chain_length",
+		Buckets:   prometheus.LinearBuckets(0, 1, maxChainLength+1),
+		Help:      "Histogram of the number of CNAME hops followed per lookup.",
+	}, []string{"server", "zone"})
+
+	// cacheHitCount and cacheMissCount count the stale cache lookups done while the database fails.
+	cacheHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pdsql",
+		Name:      "stale_cache_hits_total",
+		Help:      "Counter of failed lookups answered from the stale cache.",
+	}, []string{"server", "zone"})
+	cacheMissCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pdsql",
+		Name:      "stale_cache_misses_total",
+		Help:      "Counter of failed lookups the stale cache had no answer for.",
+	}, []string{"server", "zone"})
+
+	pools = newPoolCollector()
+)
+
+func init() {
+	prometheus.MustRegister(pools)
+}
+
+// metricLabels are the server and zone of the request a statement runs for.
+type metricLabels struct {
+	server, zone string
+}
+
+type labelsKey struct{}
+
+type kindKey struct{}
+
+// withLabels returns a context carrying the metric labels of a request.
+func withLabels(ctx context.Context, server, zone string) context.Context {
+	return context.WithValue(ctx, labelsKey{}, metricLabels{server: server, zone: zone})
+}
+
+func labelsFrom(ctx context.Context) metricLabels {
+	if ctx == nil {
+		return metricLabels{}
+	}
+	l, _ := ctx.Value(labelsKey{}).(metricLabels)
+	return l
+}
+
+// withKind marks the statements run through db with a lookup kind.
+func withKind(db *gorm.DB, kind string) *gorm.DB {
+	return db.WithContext(context.WithValue(db.Statement.Context, kindKey{}, kind))
+}
+
+func kindFrom(ctx context.Context) string {
+	if ctx != nil {
+		if kind, ok := ctx.Value(kindKey{}).(string); ok {
+			return kind
+		}
+	}
+	return "other"
+}
+
+const queryStartKey = "pdsql:query_start"
+
+// registerCallbacks instruments every statement run through db with the SQL metrics and trace spans.
+func registerCallbacks(db *gorm.DB) error {
+	cb := db.Callback()
+	if cb.Query().Get("pdsql:before_query") != nil {
+		return nil
+	}
+	for _, err := range []error{
+		cb.Query().Before("gorm:query").Register("pdsql:before_query", startQuery),
+		cb.Query().After("gorm:query").Register("pdsql:after_query", finishQuery(true)),
+		cb.Row().Before("gorm:row").Register("pdsql:before_row", startQuery),
+		cb.Row().After("gorm:row").Register("pdsql:after_row", finishQuery(false)),
+		cb.Raw().Before("gorm:raw").Register("pdsql:before_raw", startQuery),
+		cb.Raw().After("gorm:raw").Register("pdsql:after_raw", finishQuery(true)),
+		cb.Create().Before("gorm:create").Register("pdsql:before_create", startQuery),
+		cb.Create().After("gorm:create").Register("pdsql:after_create", finishQuery(true)),
+		cb.Update().Before("gorm:update").Register("pdsql:before_update", startQuery),
+		cb.Update().After("gorm:update").Register("pdsql:after_update", finishQuery(true)),
+		cb.Delete().Before("gorm:delete").Register("pdsql:before_delete", startQuery),
+		cb.Delete().After("gorm:delete").Register("pdsql:after_delete", finishQuery(true)),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startQuery(db *gorm.DB) {
+	db.InstanceSet(queryStartKey, time.Now())
+	startQuerySpan(db)
+}
+
+// finishQuery returns the callback recording a finished statement, rows tells whether
+// gorm knows the number of rows when the callback runs.
+func finishQuery(rows bool) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		finishQuerySpan(db, rows)
+
+		v, ok := db.InstanceGet(queryStartKey)
+		if !ok {
+			return
+		}
+		start := v.(time.Time)
+		ctx := db.Statement.Context
+		l := labelsFrom(ctx)
+		kind := kindFrom(ctx)
+
+		queryCount.WithLabelValues(l.server, l.zone, kind).Inc()
+		queryDuration.WithLabelValues(l.server, l.zone, kind).Observe(time.Since(start).Seconds())
+		if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+			dbErrorCount.WithLabelValues(l.server, l.zone, errorClass(db.Error)).Inc()
+		}
+	}
+}
+
+// errorClass groups database errors for the db_errors_total metric.
+func errorClass(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrBreakerOpen):
+		return "breaker"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return "timeout"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone), errors.As(err, &netErr):
+		return "connection"
+	default:
+		return "query"
+	}
+}
+
+// poolCollector exports the sql.DB.Stats of the connection pools in use.
+type poolCollector struct {
+	mu    sync.Mutex
+	pools map[metricLabels]*poolEntry
+
+	open, inUse, idle, maxOpen, waitCount, waitDuration *prometheus.Desc
+}
+
+// poolEntry counts the instances exporting a server and zone, on reload the new instance adds
+// its pool before the old one removes it.
+type poolEntry struct {
+	db   *sql.DB
+	refs int
+}
+
+func newPoolCollector() *poolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(plugin.Namespace, "pdsql", name), help, []string{"server", "zone"}, nil)
+	}
+	return &poolCollector{
+		pools:        make(map[metricLabels]*poolEntry),
+		open:         desc("pool_open_connections", "Number of established connections, in use and idle."),
+		inUse:        desc("pool_in_use_connections", "Number of connections currently in use."),
+		idle:         desc("pool_idle_connections", "Number of idle connections."),
+		maxOpen:      desc("pool_max_open_connections", "Maximum number of open connections, 0 is unlimited."),
+		waitCount:    desc("pool_wait_total", "Total number of connections waited for."),
+		waitDuration: desc("pool_wait_duration_seconds_total", "Total time blocked waiting for a new connection."),
+	}
+}
+
+// Add exports the stats of db for a server and zone, replacing the pool added before.
+func (p *poolCollector) Add(server, zone string, db *sql.DB) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := metricLabels{server: server, zone: zone}
+	e, ok := p.pools[l]
+	if !ok {
+		e = &poolEntry{}
+		p.pools[l] = e
+	}
+	e.db = db
+	e.refs++
+}
+
+// Remove stops exporting the stats for a server and zone once every Add was removed.
+func (p *poolCollector) Remove(server, zone string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := metricLabels{server: server, zone: zone}
+	if e, ok := p.pools[l]; ok {
+		if e.refs--; e.refs <= 0 {
+			delete(p.pools, l)
+		}
+	}
+}
+
+func (p *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.open
+	ch <- p.inUse
+	ch <- p.idle
+	ch <- p.maxOpen
+	ch <- p.waitCount
+	ch <- p.waitDuration
+}
+
+func (p *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for l, e := range p.pools {
+		s := e.db.Stats()
+		ch <- prometheus.MustNewConstMetric(p.open, prometheus.GaugeValue, float64(s.OpenConnections), l.server, l.zone)
+		ch <- prometheus.MustNewConstMetric(p.inUse, prometheus.GaugeValue, float64(s.InUse), l.server, l.zone)
+		ch <- prometheus.MustNewConstMetric(p.idle, prometheus.GaugeValue, float64(s.Idle), l.server, l.zone)
+		ch <- prometheus.MustNewConstMetric(p.maxOpen, prometheus.GaugeValue, float64(s.MaxOpenConnections), l.server, l.zone)
+		ch <- prometheus.MustNewConstMetric(p.waitCount, prometheus.CounterValue, float64(s.WaitCount), l.server, l.zone)
+		ch <- prometheus.MustNewConstMetric(p.waitDuration, prometheus.CounterValue, s.WaitDuration.Seconds(), l.server, l.zone)
+	}
+}
@@ -0,0 +1,111 @@
+package pdsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"gorm.io/gorm"
+)
+
+func TestMetrics(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registerCallbacks(db); err != nil {
+		t.Fatal(err)
+	}
+	zone := "metrics.example."
+	p := PowerDNSGenericSQLBackend{DB: db, zones: []string{zone}}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	domain := pdnsmodel.Domain{Name: "metrics.example", Type: "NATIVE"}
+	if err := db.Create(&domain).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []pdnsmodel.Record{
+		{DomainId: domain.ID, Name: "*.metrics.example", Type: "A", Content: "192.168.1.1", Ttl: 300},
+		{DomainId: domain.ID, Name: "www.metrics.example", Type: "CNAME", Content: "web.metrics.example", Ttl: 300},
+	} {
+		if err := db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queries := testutil.ToFloat64(queryCount.WithLabelValues("", zone, "lookup"))
+	noerror := testutil.ToFloat64(responseCount.WithLabelValues("", zone, "NOERROR"))
+	wildcards := testutil.ToFloat64(wildcardHitCount.WithLabelValues("", zone))
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.metrics.example.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if code, err := p.ServeDNS(context.TODO(), rec, req); err != nil || code != dns.RcodeSuccess {
+		t.Fatalf("Expected success, but got code %d err %v", code, err)
+	}
+
+	if n := testutil.ToFloat64(queryCount.WithLabelValues("", zone, "lookup")) - queries; n != 2 {
+		t.Errorf("Expected 2 lookup queries, but got %v", n)
+	}
+	if n := testutil.ToFloat64(responseCount.WithLabelValues("", zone, "NOERROR")) - noerror; n != 1 {
+		t.Errorf("Expected 1 NOERROR response, but got %v", n)
+	}
+	if n := testutil.ToFloat64(wildcardHitCount.WithLabelValues("", zone)) - wildcards; n != 1 {
+		t.Errorf("Expected 1 wildcard hit, but got %v", n)
+	}
+	var m dto.Metric
+	if err := cnameChainLength.WithLabelValues("", zone).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if h := m.GetHistogram(); h.GetSampleCount() != 1 || h.GetSampleSum() != 1 {
+		t.Errorf("Expected one chain of 1 hop, but got %d chains of %v hops", h.GetSampleCount(), h.GetSampleSum())
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pools.Add("dns://:53", zone, sqlDB)
+	if n := testutil.CollectAndCount(pools, "coredns_pdsql_pool_open_connections"); n != 1 {
+		t.Errorf("Expected 1 pool series, but got %d", n)
+	}
+	// a reload adds the pool of the new instance before the old one is removed
+	pools.Add("dns://:53", zone, sqlDB)
+	pools.Remove("dns://:53", zone)
+	if n := testutil.CollectAndCount(pools, "coredns_pdsql_pool_open_connections"); n != 1 {
+		t.Errorf("Expected the pool series to survive a reload, but got %d", n)
+	}
+	pools.Remove("dns://:53", zone)
+	if n := testutil.CollectAndCount(pools); n != 0 {
+		t.Errorf("Expected no pool series after remove, but got %d", n)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{ErrBreakerOpen, "breaker"},
+		{context.DeadlineExceeded, "timeout"},
+		{fmt.Errorf("query: %w", driver.ErrBadConn), "connection"},
+		{errors.New("no such table: records"), "query"},
+	}
+	for _, tc := range tests {
+		if class := errorClass(tc.err); class != tc.class {
+			t.Errorf("Expected class %s for %v, but got %s", tc.class, tc.err, class)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package pdsql
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+const (
+	// orderNone keeps the order of the database.
+	orderNone = iota
+	// orderRandom shuffles the addresses of every answer.
+	orderRandom
+	// orderRoundRobin rotates the addresses by one with every answer.
+	orderRoundRobin
+	// orderWeighted shuffles the addresses by the weight in their prio column.
+	orderWeighted
+)
+
+// orderPolicies maps the order option to the way addresses are ordered.
+var orderPolicies = map[string]int{
+	"none":        orderNone,
+	"random":      orderRandom,
+	"round-robin": orderRoundRobin,
+	"weighted":    orderWeighted,
+}
+
+// answerOrder orders the A and AAAA RRsets of the answers of a zone, and keeps the first max addresses.
+type answerOrder struct {
+	policy int
+	// max is the number of addresses kept of an RRset, 0 keeps all.
+	max  int
+	next uint64
+}
+
+// answerOrder returns the order of the zone closest to qname, nil when no order is configured.
+func (pdb PowerDNSGenericSQLBackend) answerOrder(qname string) *answerOrder {
+	if len(pdb.orders) == 0 {
+		return nil
+	}
+	zones := make([]string, 0, len(pdb.orders))
+	for zone := range pdb.orders {
+		zones = append(zones, zone)
+	}
+	return pdb.orders[plugin.Zones(zones).Matches(qname)]
+}
+
+// Apply orders every A and AAAA RRset of answer, weights holds the prio of the records.
+// The other records and the position of the RRsets in the answer are kept.
+func (o *answerOrder) Apply(answer []dns.RR, weights map[dns.RR]int) []dns.RR {
+	if o == nil {
+		return answer
+	}
+
+	out := make([]dns.RR, 0, len(answer))
+	for i := 0; i < len(answer); {
+		j := i + 1
+		hdr := answer[i].Header()
+		for j < len(answer) && answer[j].Header().Rrtype == hdr.Rrtype && equal(answer[j].Header().Name, hdr.Name) {
+			j++
+		}
+		rrset := answer[i:j]
+		if hdr.Rrtype == dns.TypeA || hdr.Rrtype == dns.TypeAAAA {
+			rrset = o.order(append([]dns.RR(nil), rrset...), weights)
+		}
+		out = append(out, rrset...)
+		i = j
+	}
+	return out
+}
+
+func (o *answerOrder) order(rrset []dns.RR, weights map[dns.RR]int) []dns.RR {
+	switch o.policy {
+	case orderRandom:
+		rand.Shuffle(len(rrset), func(i, j int) { rrset[i], rrset[j] = rrset[j], rrset[i] })
+	case orderRoundRobin:
+		n := int(atomic.AddUint64(&o.next, 1) % uint64(len(rrset)))
+		rrset = append(rrset[n:], rrset[:n]...)
+	case orderWeighted:
+		weightedShuffle(rrset, weights)
+	}
+	if o.max > 0 && len(rrset) > o.max {
+		rrset = rrset[:o.max]
+	}
+	return rrset
+}
+
+// weightedShuffle orders rrset randomly with the probability of a record to come first proportional
+// to its weight, records of weight 0 come last. All weights 0 shuffles uniformly.
+func weightedShuffle(rrset []dns.RR, weights map[dns.RR]int) {
+	keys := make(map[dns.RR]float64, len(rrset))
+	positive := false
+	for _, rr := range rrset {
+		if weights[rr] > 0 {
+			positive = true
+		}
+	}
+	for _, rr := range rrset {
+		w := float64(weights[rr])
+		if !positive {
+			w = 1
+		}
+		if w <= 0 {
+			keys[rr] = -1
+			continue
+		}
+		// Efraimidis and Spirakis, the largest keys win
+		keys[rr] = math.Pow(rand.Float64(), 1/w)
+	}
+	sort.SliceStable(rrset, func(i, j int) bool { return keys[rrset[i]] > keys[rrset[j]] })
+}
@@ -0,0 +1,121 @@
+package pdsql
+
+import (
+	"testing"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+func addresses(rrs []dns.RR) []string {
+	var out []string
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			out = append(out, rr.A.String())
+		case *dns.AAAA:
+			out = append(out, rr.AAAA.String())
+		default:
+			out = append(out, dns.TypeToString[rr.Header().Rrtype])
+		}
+	}
+	return out
+}
+
+func TestAnswerOrderApply(t *testing.T) {
+	answer := []dns.RR{
+		test.CNAME("www.example.org. 60 IN CNAME web.example.org."),
+		test.A("web.example.org. 60 IN A 192.0.2.1"),
+		test.A("web.example.org. 60 IN A 192.0.2.2"),
+		test.A("web.example.org. 60 IN A 192.0.2.3"),
+	}
+
+	var none *answerOrder
+	if got := none.Apply(answer, nil); len(got) != len(answer) {
+		t.Fatalf("Expected the answer kept without an order, but got %v", got)
+	}
+
+	rr := &answerOrder{policy: orderRoundRobin}
+	for i, expected := range [][]string{
+		{"CNAME", "192.0.2.2", "192.0.2.3", "192.0.2.1"},
+		{"CNAME", "192.0.2.3", "192.0.2.1", "192.0.2.2"},
+		{"CNAME", "192.0.2.1", "192.0.2.2", "192.0.2.3"},
+	} {
+		got := addresses(rr.Apply(answer, nil))
+		if len(got) != len(expected) {
+			t.Fatalf("Expected %v in answer %d, but got %v", expected, i, got)
+		}
+		for j := range expected {
+			if got[j] != expected[j] {
+				t.Fatalf("Expected %v in answer %d, but got %v", expected, i, got)
+			}
+		}
+	}
+	if got := addresses(answer); got[1] != "192.0.2.1" {
+		t.Errorf("Expected the answer not to be modified, but got %v", got)
+	}
+
+	max := &answerOrder{policy: orderRandom, max: 2}
+	if got := addresses(max.Apply(answer, nil)); len(got) != 3 || got[0] != "CNAME" {
+		t.Errorf("Expected the CNAME and 2 addresses, but got %v", got)
+	}
+
+	weighted := &answerOrder{policy: orderWeighted}
+	weights := map[dns.RR]int{answer[1]: 0, answer[2]: 10, answer[3]: 0}
+	for i := 0; i < 20; i++ {
+		if got := addresses(weighted.Apply(answer, weights)); got[1] != "192.0.2.2" {
+			t.Fatalf("Expected the only weighted address first, but got %v", got)
+		}
+	}
+	zero := map[dns.RR]int{}
+	if got := weighted.Apply(answer, zero); len(got) != len(answer) {
+		t.Errorf("Expected all addresses with all weights 0, but got %v", addresses(got))
+	}
+}
+
+func TestServeOrderedAddresses(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{DB: db, orders: map[string]*answerOrder{
+		"example.org.": {policy: orderRoundRobin, max: 1},
+	}}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []pdnsmodel.Record{
+		{Name: "www.example.org", Type: "A", Content: "192.0.2.1", Ttl: 60},
+		{Name: "www.example.org", Type: "A", Content: "192.0.2.2", Ttl: 60},
+		{Name: "www.example.net", Type: "A", Content: "192.0.2.1", Ttl: 60},
+		{Name: "www.example.net", Type: "A", Content: "192.0.2.2", Ttl: 60},
+	} {
+		if err := db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := func(name string) []string {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := p.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatalf("Expected no error for %s, but got %v", name, err)
+		}
+		return addresses(rec.Msg.Answer)
+	}
+
+	first, second := query("www.example.org."), query("www.example.org.")
+	if len(first) != 1 || len(second) != 1 || first[0] == second[0] {
+		t.Errorf("Expected one rotating address, but got %v and %v", first, second)
+	}
+	if got := query("www.example.net."); len(got) != 2 {
+		t.Errorf("Expected all addresses outside the ordered zone, but got %v", got)
+	}
+}
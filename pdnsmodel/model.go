@@ -4,7 +4,7 @@ import "database/sql"
 
 type Domain struct {
 	ID             uint           `gorm:"primary_key"`
-	Name           string         `gorm:"type:varchar(255);not null"`
+	Name           string         `gorm:"type:varchar(255);not null;uniqueIndex:name_index"`
 	Master         sql.NullString `gorm:"type:varchar(128)"`
 	LastCheck      sql.NullInt64
 	Type           string `gorm:"type:varchar(6);not null"`
@@ -13,10 +13,10 @@ type Domain struct {
 }
 
 type Record struct {
-	ID         uint `gorm:"primary_key"`
-	DomainId   uint
-	Name       string `gorm:"type:varchar(255);not null"`
-	Type       string `gorm:"type:varchar(10)"`
+	ID         uint   `gorm:"primary_key"`
+	DomainId   uint   `gorm:"index:domain_id"`
+	Name       string `gorm:"type:varchar(255);not null;index:nametype_index,priority:1"`
+	Type       string `gorm:"type:varchar(10);index:nametype_index,priority:2"`
 	Content    string `gorm:"type:text"`
 	Ttl        uint32
 	Prio       int
@@ -25,3 +25,14 @@ type Record struct {
 	//ordername             VARCHAR(255) BINARY DEFAULT NULL,
 	//auth                  TINYINT(1) DEFAULT 1,
 }
+
+// Comment is a comment on the RRset Name and Type, as in the PowerDNS comments table.
+type Comment struct {
+	ID         uint           `gorm:"primary_key"`
+	DomainId   uint           `gorm:"not null;index:comments_domain_id_idx"`
+	Name       string         `gorm:"type:varchar(255);not null;index:comments_name_type_idx,priority:1"`
+	Type       string         `gorm:"type:varchar(10);not null;index:comments_name_type_idx,priority:2"`
+	ModifiedAt int            `gorm:"not null"`
+	Account    sql.NullString `gorm:"type:varchar(40)"`
+	Comment    string         `gorm:"type:text;not null"`
+}
@@ -2,14 +2,15 @@
 package pdsql
 
 import (
-	"fmt"
-	"net"
+	"errors"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/wenerme/coredns-pdsql/pdnsmodel"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 	"golang.org/x/net/context"
@@ -21,7 +22,32 @@ const Name = "pdsql"
 type PowerDNSGenericSQLBackend struct {
 	*gorm.DB
 	Debug bool
-	Next  plugin.Handler
+	// Strict fails the whole answer with SERVFAIL when a record is malformed instead of dropping it.
+	Strict bool
+	Next   plugin.Handler
+
+	stale   *staleCache
+	breaker *breaker
+	queries *Queries
+	health  *healthProbe
+	conn    *connector
+	// classPolicy is the rcode for non IN queries, classFallthrough passes them on, 0 refuses them.
+	classPolicy int
+	// chaos holds the TXT answers of CHAOS class names.
+	chaos map[string][]string
+	// anyMode is the way ANY queries are answered, anyUDP allows full answers over UDP.
+	anyMode int
+	anyUDP  bool
+	// alias resolves ALIAS targets outside the database.
+	alias *aliasResolver
+	// checker probes the addresses of LUA records and checked RRsets.
+	checker *targetChecker
+	// checks drops the addresses failing their health check from the answers.
+	checks *addressChecks
+	// orders holds the order of the addresses by zone.
+	orders map[string]*answerOrder
+	// zones of the server block, used to label the metrics.
+	zones []string
 }
 
 func (pdb PowerDNSGenericSQLBackend) Name() string { return Name }
@@ -32,150 +58,130 @@ func (pdb PowerDNSGenericSQLBackend) ServeDNS(ctx context.Context, w dns.Respons
 	a.Compress = true
 	a.Authoritative = true
 
-	records, err := pdb.ResolveRequest(state.QName(), state.QType())
+	server, zone := metrics.WithServer(ctx), plugin.Zones(pdb.zones).Matches(state.Name())
+	if state.QClass() != dns.ClassINET {
+		return pdb.serveClass(ctx, w, r, state, metricLabels{server: server, zone: zone})
+	}
+	if !pdb.conn.Connected() {
+		if pdb.conn.fall {
+			return plugin.NextOrFailure(pdb.Name(), pdb.Next, ctx, w, r)
+		}
+		responseCount.WithLabelValues(server, zone, dns.RcodeToString[dns.RcodeServerFailure]).Inc()
+		return dns.RcodeServerFailure, ErrNotConnected
+	}
 
+	ctx = withLabels(ctx, server, zone)
+	records, stats, err := pdb.resolve(ctx, state)
 	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			soa, err := pdb.ResolveSOA(state.QName())
-
-			if err != nil {
-				return dns.RcodeServerFailure, err
-			}
-
-			rr := new(dns.SOA)
-			rr.Hdr = dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeSOA, Class: state.QClass()}
-
-			if ParseSOA(rr, soa.Content) {
-				a.Extra = append(a.Extra, rr)
-			}
-		} else {
-			return dns.RcodeServerFailure, err
+		if pdb.Debug {
+			log.Infof("lookup failed qname=%s qtype=%s error=%q", state.Name(), state.Type(), err)
 		}
-	}
-	if len(records) == 0 {
-		records, err = pdb.SearchWildcard(state.QName(), state.QType())
-		if err != nil {
-			return dns.RcodeServerFailure, err
+		if pdb.stale.Lookup(state.QName(), state.QType(), a) {
+			preserveCase(state.QName(), a.Answer)
+			cacheHitCount.WithLabelValues(server, zone).Inc()
+			responseCount.WithLabelValues(server, zone, dns.RcodeToString[a.Rcode]).Inc()
+			return 0, writeMsg(state, a)
 		}
+		cacheMissCount.WithLabelValues(server, zone).Inc()
+		responseCount.WithLabelValues(server, zone, dns.RcodeToString[dns.RcodeServerFailure]).Inc()
+		return dns.RcodeServerFailure, err
 	}
 
+	// the prio of the addresses, for the weighted order
+	var weights map[dns.RR]int
+	order := pdb.answerOrder(state.Name())
+	if order != nil {
+		weights = make(map[dns.RR]int, len(records))
+	}
 	for _, v := range records {
-		typ := dns.StringToType[v.Type]
-		hrd := dns.RR_Header{Name: v.Name, Rrtype: typ, Class: state.QClass(), Ttl: v.Ttl}
-		if !strings.HasSuffix(hrd.Name, ".") {
-			hrd.Name += "."
+		rrs, err := pdb.toAnswer(ctx, state, v)
+		if errors.Is(err, ErrMalformedRecord) && !pdb.Strict {
+			log.Warningf("drop %v qname=%s", err, state.Name())
+			malformedRecordCount.WithLabelValues(server, zone, v.Type).Inc()
+			continue
 		}
-		rr := dns.TypeToRR[typ]()
-
-		// todo support more type
-		// this is enough for most query
-		switch rr := rr.(type) {
-		case *dns.SOA:
-			rr.Hdr = hrd
-			if !ParseSOA(rr, v.Content) {
-				rr = nil
-			}
-		case *dns.A:
-			rr.Hdr = hrd
-			rr.A = net.ParseIP(v.Content)
-		case *dns.AAAA:
-			rr.Hdr = hrd
-			rr.AAAA = net.ParseIP(v.Content)
-		case *dns.TXT:
-			rr.Hdr = hrd
-			rr.Txt = []string{v.Content}
-		case *dns.NS:
-			rr.Hdr = hrd
-			if strings.HasSuffix(v.Content, ".") {
-				rr.Ns = v.Content
-			} else {
-				rr.Ns = v.Content + "."
-			}
-		case *dns.PTR:
-			rr.Hdr = hrd
-			// pdns doesn't need the dot but when we answer, we need it
-			if strings.HasSuffix(v.Content, ".") {
-				rr.Ptr = v.Content
-			} else {
-				rr.Ptr = v.Content + "."
-			}
-		case *dns.CNAME:
-			rr.Hdr = hrd
-			if strings.HasSuffix(v.Content, ".") {
-				rr.Target = v.Content
-			} else {
-				rr.Target = v.Content + "."
+		if err != nil {
+			responseCount.WithLabelValues(server, zone, dns.RcodeToString[dns.RcodeServerFailure]).Inc()
+			return dns.RcodeServerFailure, err
+		}
+		if weights != nil {
+			for _, rr := range rrs {
+				weights[rr] = v.Prio
 			}
+		}
+		a.Answer = append(a.Answer, rrs...)
+	}
 
-		case *dns.MX:
-			rr.Hdr = hrd
+	if len(a.Answer) == 0 {
+		return plugin.NextOrFailure(pdb.Name(), pdb.Next, ctx, w, r)
+	}
+	if pdb.truncateANY(state) {
+		a.Answer = nil
+		a.Truncated = true
+		responseCount.WithLabelValues(server, zone, dns.RcodeToString[a.Rcode]).Inc()
+		return 0, writeMsg(state, a)
+	}
+	if stats.yxdomain {
+		a.Rcode = dns.RcodeYXDomain
+	}
+	a.Answer = pdb.checks.Filter(a.Answer)
+	a.Answer = order.Apply(a.Answer, weights)
+	a.Answer = pdb.minimalANY(state, a.Answer)
+	preserveCase(state.QName(), a.Answer)
+	if state.QType() == dns.TypeSVCB || state.QType() == dns.TypeHTTPS {
+		a.Extra = pdb.svcbAdditional(ctx, zone, a.Answer)
+	}
 
-			// PowerDNS requires for MX Records the Priority to be set
-			if v.Prio != 0 {
-				rr.Preference = uint16(v.Prio)
-				if strings.HasSuffix(v.Content, ".") {
-					rr.Mx = v.Content
-				} else {
-					rr.Mx = v.Content + "."
-				}
-			} else {
-				parts := strings.Split(v.Content, " ")
-
-				if len(parts) == 2 {
-					preference, host := parts[0], parts[1]
-					if pref, err := strconv.Atoi(preference); err == nil {
-						rr.Preference = uint16(pref)
-					} else {
-						return dns.RcodeServerFailure, fmt.Errorf("invalid MX preference: %s", preference)
-					}
-					if strings.HasSuffix(host, ".") {
-						rr.Mx = host
-					} else {
-						rr.Mx = host + "."
-					}
-				} else {
-					return dns.RcodeServerFailure, fmt.Errorf("malformed MX record content: %s", v.Content)
-				}
-			}
+	pdb.stale.Store(state.QName(), state.QType(), a)
+	responseCount.WithLabelValues(server, zone, dns.RcodeToString[a.Rcode]).Inc()
+	return 0, writeMsg(state, a)
+}
 
-		case *dns.SRV:
-			rr.Hdr = hrd
-			parts := strings.Split(v.Content, " ")
-			if len(parts) != 4 {
-				return dns.RcodeServerFailure, fmt.Errorf("malformed SRV record content: %s - parts=%d", v.Content, len(parts))
-			}
-			if priority, err := strconv.Atoi(parts[0]); err == nil {
-				rr.Priority = uint16(priority)
-			} else {
-				return dns.RcodeServerFailure, fmt.Errorf("invalid SRV priority: %s", parts[0])
-			}
-			if weight, err := strconv.Atoi(parts[1]); err == nil {
-				rr.Weight = uint16(weight)
-			} else {
-				return dns.RcodeServerFailure, fmt.Errorf("invalid SRV weight: %s", parts[1])
-			}
-			if port, err := strconv.Atoi(parts[2]); err == nil {
-				rr.Port = uint16(port)
-			} else {
-				return dns.RcodeServerFailure, fmt.Errorf("invalid SRV port: %s", parts[2])
-			}
-			rr.Target = parts[3]
-		default:
-			// drop unsupported
+// toAnswer converts a record row to the records of the answer, expanding ALIAS and LUA records.
+func (pdb PowerDNSGenericSQLBackend) toAnswer(ctx context.Context, state request.Request, v *pdnsmodel.Record) ([]dns.RR, error) {
+	switch v.Type {
+	case "ALIAS":
+		rrs, err := pdb.expandALIAS(ctx, v, state.QType())
+		if err != nil {
+			log.Warningf("alias %v qname=%s", err, state.Name())
 		}
+		return rrs, err
+	case "LUA":
+		return pdb.expandLUA(ctx, state, v)
+	}
+	rr, err := ToRR(v, dns.ClassINET)
+	if err != nil || rr == nil {
+		return nil, err
+	}
+	return []dns.RR{rr}, nil
+}
 
-		if rr == nil {
-			// invalid record
-		} else {
-			a.Answer = append(a.Answer, rr)
-		}
+// resolve queries the database for the records answering the request, guarded by the circuit breaker.
+func (pdb PowerDNSGenericSQLBackend) resolve(ctx context.Context, state request.Request) ([]*pdnsmodel.Record, lookupStats, error) {
+	l := labelsFrom(ctx)
+	if !pdb.breaker.Allow(ctx, pdb.DB) {
+		dbErrorCount.WithLabelValues(l.server, l.zone, errorClass(ErrBreakerOpen)).Inc()
+		return nil, lookupStats{}, ErrBreakerOpen
 	}
 
-	if len(a.Answer) == 0 {
-		return plugin.NextOrFailure(pdb.Name(), pdb.Next, ctx, w, r)
+	pdb.DB = pdb.DB.WithContext(ctx)
+	start := time.Now()
+	records, stats, err := pdb.lookup(state.QName(), state.QType())
+	if err != nil {
+		pdb.breaker.Failure()
+		return nil, stats, err
+	}
+	pdb.breaker.Success()
+	if pdb.Debug {
+		log.Infof("lookup qname=%s qtype=%s domain_id=%d rows=%d chain=%d wildcard=%t duration=%s",
+			state.Name(), state.Type(), stats.domainID, len(records), stats.chain, stats.wildcard, time.Since(start))
 	}
 
-	return 0, w.WriteMsg(a)
+	if stats.wildcard {
+		wildcardHitCount.WithLabelValues(l.server, l.zone).Inc()
+	}
+	cnameChainLength.WithLabelValues(l.server, l.zone).Observe(float64(stats.chain))
+	return records, stats, nil
 }
 
 func (pdb *PowerDNSGenericSQLBackend) ResolveRequest(qname string, qtype uint16) ([]*pdnsmodel.Record, error) {
@@ -246,8 +252,6 @@ func (pdb *PowerDNSGenericSQLBackend) ResolveSOA(qname string) (*pdnsmodel.Recor
 		Where("disabled = ?", false)
 
 	if err := query.Find(&soaRecord).Error; err == nil {
-		fmt.Printf("pdsql - ResolveRequest(): soa rec: %#v'\n", soaRecord)
-
 		return &soaRecord, err
 	} else {
 		return nil, err
@@ -417,8 +421,8 @@ func ParseSOA(rr *dns.SOA, line string) bool {
 	if len(splites) < 7 {
 		return false
 	}
-	rr.Ns = splites[0]
-	rr.Mbox = splites[1]
+	rr.Ns = dns.Fqdn(splites[0])
+	rr.Mbox = dns.Fqdn(splites[1])
 	if i, err := strconv.Atoi(splites[2]); err != nil {
 		return false
 	} else {
@@ -477,6 +481,16 @@ func WildcardMatch(s1, s2 string) bool {
 	return match
 }
 
+// preserveCase sets the owner name of the records owned by qname to the casing of the question,
+// resolvers using 0x20 randomization expect it echoed back.
+func preserveCase(qname string, rrs []dns.RR) {
+	for _, rr := range rrs {
+		if hdr := rr.Header(); hdr.Name != qname && equal(hdr.Name, qname) {
+			hdr.Name = qname
+		}
+	}
+}
+
 func equal(a, b string) bool {
 	if b == "*" || a == "*" {
 		return true
@@ -1,6 +1,7 @@
 package pdsql_test
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"testing"
@@ -136,7 +137,7 @@ func TestPowerDNSSQL(t *testing.T) {
 			qtype:          dns.TypeA,
 			expectedCode:   dns.RcodeSuccess,
 			expectedType:   []uint16{dns.TypeCNAME, dns.TypeA},
-			expectedHeader: []string{"nocase.example.org."},
+			expectedHeader: []string{"NoCase.Example.ORG."},
 			expectedReply:  []string{"nocase.example.org.", "192.168.1.1"},
 			expectedErr:    nil,
 			rrReply: []dns.RR{
@@ -148,7 +149,7 @@ func TestPowerDNSSQL(t *testing.T) {
 			qtype:          dns.TypeANY,
 			expectedCode:   dns.RcodeSuccess,
 			expectedType:   []uint16{dns.TypeCNAME},
-			expectedHeader: []string{"not.exists.example.org."},
+			expectedHeader: []string{"NOT.Exists.Example.ORG."},
 			expectedReply:  []string{"example.org."},
 			expectedErr:    nil,
 			rrReply: []dns.RR{
@@ -160,7 +161,7 @@ func TestPowerDNSSQL(t *testing.T) {
 			qtype:          dns.TypeA,
 			expectedCode:   dns.RcodeSuccess,
 			expectedType:   []uint16{dns.TypeCNAME, dns.TypeA},
-			expectedHeader: []string{"not.exists.example.org."},
+			expectedHeader: []string{"NOT.Exists.Example.ORG."},
 			expectedReply:  []string{"example.org.", "192.168.1.1"},
 			expectedErr:    nil,
 			rrReply: []dns.RR{
@@ -172,7 +173,7 @@ func TestPowerDNSSQL(t *testing.T) {
 			qtype:          dns.TypeAAAA,
 			expectedCode:   dns.RcodeSuccess,
 			expectedType:   []uint16{dns.TypeCNAME, dns.TypeAAAA},
-			expectedHeader: []string{"not.exists.example.org."},
+			expectedHeader: []string{"NOT.Exists.Example.ORG."},
 			expectedReply:  []string{"example.org.", "::ffff:c0a8:101"},
 			expectedErr:    nil,
 			rrReply: []dns.RR{
@@ -233,7 +234,8 @@ func TestPowerDNSSQL(t *testing.T) {
 		req := new(dns.Msg)
 		req.SetQuestion(dns.Fqdn(tc.qname), tc.qtype)
 
-		observed := dnstest.NewRecorder(&test.ResponseWriter{})
+		// full ANY answers are only sent over TCP
+		observed := dnstest.NewRecorder(&test.ResponseWriter{TCP: tc.qtype == dns.TypeANY})
 		code, err := p.ServeDNS(ctx, observed, req)
 
 		if err != tc.expectedErr {
@@ -325,6 +327,50 @@ func TestPowerDNSSQL(t *testing.T) {
 	}
 }
 
+func TestMalformedRecords(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := pdsql.PowerDNSGenericSQLBackend{DB: db}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	testRecords := []pdnsmodel.Record{
+		{Name: "example.org", Type: "MX", Content: "10 mail.example.org", Ttl: 3600},
+		{Name: "example.org", Type: "MX", Content: "ten mail2.example.org", Ttl: 3600},
+		{Name: "_sip._udp.example.org", Type: "SRV", Content: "10 10 5060", Ttl: 3600},
+	}
+	for _, r := range testRecords {
+		if err := p.DB.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeMX)
+	observed := dnstest.NewRecorder(&test.ResponseWriter{})
+	code, err := p.ServeDNS(context.TODO(), observed, req)
+	if err != nil || code != dns.RcodeSuccess {
+		t.Fatalf("Expected malformed record to be dropped, but got code %d err %v", code, err)
+	}
+	if len(observed.Msg.Answer) != 1 || observed.Msg.Answer[0].(*dns.MX).Mx != "mail.example.org." {
+		t.Errorf("Expected the valid MX only, but got %v", observed.Msg.Answer)
+	}
+
+	p.Strict = true
+	code, err = p.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+	if !errors.Is(err, pdsql.ErrMalformedRecord) || code != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL in strict mode, but got code %d err %v", code, err)
+	}
+	var re *pdsql.RecordError
+	if !errors.As(err, &re) || re.ID != 2 {
+		t.Errorf("Expected RecordError for record 2, but got %v", err)
+	}
+}
+
 func TestWildcardMatch(t *testing.T) {
 
 	tests := []struct {
@@ -0,0 +1,168 @@
+package pdsql
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/jackc/pgx/v5"
+	"github.com/miekg/dns"
+	"gorm.io/gorm"
+)
+
+// DefaultNotifyChannel is the PostgreSQL channel used by the change triggers.
+const DefaultNotifyChannel = "pdsql"
+
+var channelPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// InstallNotifyTriggers creates triggers on the records and domains tables which
+// pg_notify the changed domain id on channel. It only works on PostgreSQL.
+func InstallNotifyTriggers(db *gorm.DB, channel string) error {
+	if db.Dialector.Name() != "postgres" {
+		return fmt.Errorf("notify triggers require postgres, got %s", db.Dialector.Name())
+	}
+	if !channelPattern.MatchString(channel) {
+		return fmt.Errorf("invalid notify channel %q", channel)
+	}
+
+	statements := []string{
+		`CREATE OR REPLACE FUNCTION pdsql_notify() RETURNS trigger AS $$
+DECLARE
+	id text;
+BEGIN
+	IF TG_OP <> 'INSERT' THEN
+		id := to_jsonb(OLD) ->> TG_ARGV[1];
+		IF id IS NOT NULL THEN
+			PERFORM pg_notify(TG_ARGV[0], id);
+		END IF;
+	END IF;
+	IF TG_OP <> 'DELETE' THEN
+		id := to_jsonb(NEW) ->> TG_ARGV[1];
+		IF id IS NOT NULL THEN
+			PERFORM pg_notify(TG_ARGV[0], id);
+		END IF;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS pdsql_notify ON records`,
+		fmt.Sprintf(`CREATE TRIGGER pdsql_notify AFTER INSERT OR UPDATE OR DELETE ON records
+	FOR EACH ROW EXECUTE PROCEDURE pdsql_notify('%s', 'domain_id')`, channel),
+		`DROP TRIGGER IF EXISTS pdsql_notify ON domains`,
+		fmt.Sprintf(`CREATE TRIGGER pdsql_notify AFTER INSERT OR UPDATE OR DELETE ON domains
+	FOR EACH ROW EXECUTE PROCEDURE pdsql_notify('%s', 'id')`, channel),
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range statements {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// changeListener listens for the notifications sent by the triggers, drops the stale
+// answers of the changed zone and sends DNS NOTIFY for it through the transfer plugin.
+type changeListener struct {
+	backend  PowerDNSGenericSQLBackend
+	dsn      string
+	channel  string
+	transfer *transfer.Transfer
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newChangeListener(backend PowerDNSGenericSQLBackend, dsn, channel string) *changeListener {
+	return &changeListener{backend: backend, dsn: dsn, channel: channel}
+}
+
+func (l *changeListener) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	l.done = make(chan struct{})
+	go l.run(ctx)
+	return nil
+}
+
+func (l *changeListener) Stop() error {
+	if l.cancel == nil {
+		return nil
+	}
+	l.cancel()
+	<-l.done
+	return nil
+}
+
+func (l *changeListener) run(ctx context.Context) {
+	defer close(l.done)
+	backoff := time.Second
+	for {
+		err := l.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warningf("listen failed channel=%s retry=%s error=%q", l.channel, backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (l *changeListener) listen(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, l.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{l.channel}.Sanitize()); err != nil {
+		return err
+	}
+	// changes made while we were disconnected were missed
+	l.Handle("")
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		l.Handle(n.Payload)
+	}
+}
+
+// Handle processes a notification payload holding the changed domain id.
+// An empty or unknown payload invalidates every zone.
+func (l *changeListener) Handle(payload string) {
+	id, err := strconv.ParseUint(payload, 10, 64)
+	if err != nil {
+		l.backend.stale.Purge("")
+		return
+	}
+
+	var domains []pdnsmodel.Domain
+	if err := l.backend.Where("id = ?", id).Limit(1).Find(&domains).Error; err != nil || len(domains) == 0 {
+		// the domain is gone or we can not tell which one it was
+		l.backend.stale.Purge("")
+		return
+	}
+
+	zone := dns.Fqdn(strings.ToLower(domains[0].Name))
+	l.backend.stale.Purge(zone)
+	if err := l.transfer.Notify(zone); err != nil {
+		log.Warningf("notify failed zone=%s error=%q", zone, err)
+	}
+}
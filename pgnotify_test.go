@@ -0,0 +1,58 @@
+package pdsql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"gorm.io/gorm"
+)
+
+func TestInstallNotifyTriggersRequiresPostgres(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := InstallNotifyTriggers(db, DefaultNotifyChannel); err == nil {
+		t.Fatal("Expected error on sqlite")
+	}
+}
+
+func TestChangeListenerHandle(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{DB: db, stale: newStaleCache(time.Minute, 30)}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	domain := &pdnsmodel.Domain{Name: "Example.org", Type: "NATIVE"}
+	if err := p.DB.Create(domain).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{test.A("a.example.org. 10 IN A 192.168.1.1")}
+	p.stale.Store("a.example.org.", dns.TypeA, m)
+	p.stale.Store("example.net.", dns.TypeA, m)
+
+	l := newChangeListener(p, "", DefaultNotifyChannel)
+	l.Handle("1")
+
+	if p.stale.Lookup("a.example.org.", dns.TypeA, new(dns.Msg)) {
+		t.Error("Expected entries of the changed zone to be purged")
+	}
+	if !p.stale.Lookup("example.net.", dns.TypeA, new(dns.Msg)) {
+		t.Error("Expected entries of other zones to be kept")
+	}
+
+	l.Handle("42")
+	if p.stale.Lookup("example.net.", dns.TypeA, new(dns.Msg)) {
+		t.Error("Expected unknown domain to purge every zone")
+	}
+}
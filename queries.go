@@ -0,0 +1,159 @@
+package pdsql
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/miekg/dns"
+	"gorm.io/gorm"
+)
+
+// Queries holds the SQL templates used instead of the built in lookup statement,
+// they are executed as prepared statements with named parameters.
+type Queries struct {
+	// Record returns the records of @name with a type in @types.
+	Record string
+	// Any returns all records of @name.
+	Any string
+	// Zone returns the id and name of the domains named in @names.
+	Zone string
+	// Wildcard returns the records of domain @domain_id named in @names.
+	Wildcard string
+	// DNAME returns the DNAME records named in @names, empty skips DNAME records.
+	DNAME string
+}
+
+const recordColumns = "id, domain_id, name, type, content, ttl, prio"
+
+// DefaultQueries returns templates equivalent to the built in lookup for the PowerDNS schema.
+func DefaultQueries() *Queries {
+	return &Queries{
+		Record:   "SELECT " + recordColumns + " FROM records WHERE disabled = false AND name = @name AND type IN @types",
+		Any:      "SELECT " + recordColumns + " FROM records WHERE disabled = false AND name = @name",
+		Zone:     "SELECT id, name, type FROM domains WHERE name IN @names",
+		Wildcard: "SELECT " + recordColumns + " FROM records WHERE disabled = false AND domain_id = @domain_id AND name IN @names",
+		DNAME:    "SELECT " + recordColumns + " FROM records WHERE disabled = false AND type = 'DNAME' AND name IN @names",
+	}
+}
+
+var (
+	queryParams = map[string][]string{
+		"record":   {"name", "types"},
+		"any":      {"name"},
+		"zone":     {"names"},
+		"wildcard": {"domain_id", "names"},
+		"dname":    {"names"},
+	}
+	paramPattern = regexp.MustCompile(`@(\w+)`)
+)
+
+// Set replaces the template of kind, one of record, any, zone, wildcard or dname.
+func (q *Queries) Set(kind, query string) error {
+	params, ok := queryParams[kind]
+	if !ok {
+		return fmt.Errorf("unknown query kind %q", kind)
+	}
+	for _, m := range paramPattern.FindAllStringSubmatch(query, -1) {
+		if !contains(params, m[1]) {
+			return fmt.Errorf("unknown parameter @%s in %s query, expected one of %v", m[1], kind, params)
+		}
+	}
+
+	switch kind {
+	case "record":
+		q.Record = query
+	case "any":
+		q.Any = query
+	case "zone":
+		q.Zone = query
+	case "wildcard":
+		q.Wildcard = query
+	case "dname":
+		q.DNAME = query
+	}
+	return nil
+}
+
+// lookupTemplates fills res using the configured templates, the zone and wildcard
+// queries only run when the name does not exist. A DNAME above the name occludes
+// its records like in the built in lookup.
+func (pdb PowerDNSGenericSQLBackend) lookupTemplates(res *lookupResult, qtype uint16, zones, wildcards []string) (*lookupResult, error) {
+	db := pdb.Session(&gorm.Session{PrepareStmt: true})
+
+	if pdb.queries.DNAME != "" && len(zones) > 1 {
+		var dnames []*pdnsmodel.Record
+		if err := withKind(db, "dname").Raw(pdb.queries.DNAME, sql.Named("names", zones[1:])).Scan(&dnames).Error; err != nil {
+			return nil, err
+		}
+		if len(dnames) != 0 {
+			if err := pdb.templateDomain(db, res, zones); err != nil {
+				return nil, err
+			}
+			if res.pickDNAME(dnames); res.dname != nil {
+				return res, nil
+			}
+		}
+	}
+
+	var err error
+	if qtype == dns.TypeANY {
+		err = withKind(db, "any").Raw(pdb.queries.Any, sql.Named("name", res.name)).Scan(&res.exact).Error
+	} else {
+		types := []string{dns.TypeToString[qtype], "CNAME", "LUA"}
+		if qtype == dns.TypeA || qtype == dns.TypeAAAA {
+			types = append(types, "ALIAS")
+		}
+		err = withKind(db, "record").Raw(pdb.queries.Record, sql.Named("name", res.name), sql.Named("types", types)).Scan(&res.exact).Error
+	}
+	if err != nil || len(res.exact) != 0 {
+		return res, err
+	}
+	if qtype != dns.TypeANY {
+		// a name with records of other types, or an empty non-terminal, is not covered by a wildcard
+		if err := withKind(db, "any").Raw(pdb.queries.Any, sql.Named("name", res.name)).Scan(&res.exact).Error; err != nil || len(res.exact) != 0 {
+			return res, err
+		}
+	}
+
+	if res.domain == nil {
+		if err := pdb.templateDomain(db, res, zones); err != nil {
+			return nil, err
+		}
+	}
+	if res.domain == nil || len(wildcards) == 0 {
+		return res, nil
+	}
+
+	var candidates []*pdnsmodel.Record
+	if err := withKind(db, "wildcard").Raw(pdb.queries.Wildcard, sql.Named("domain_id", res.domain.ID), sql.Named("names", wildcards)).Scan(&candidates).Error; err != nil {
+		return nil, err
+	}
+	res.pickWildcard(candidates)
+	return res, nil
+}
+
+// templateDomain sets the closest of the domains named in zones on res.
+func (pdb PowerDNSGenericSQLBackend) templateDomain(db *gorm.DB, res *lookupResult, zones []string) error {
+	var domains []pdnsmodel.Domain
+	if err := withKind(db, "zone").Raw(pdb.queries.Zone, sql.Named("names", zones)).Scan(&domains).Error; err != nil {
+		return err
+	}
+	for i := range domains {
+		if res.domain == nil || len(domains[i].Name) > len(res.domain.Name) {
+			res.domain = &domains[i]
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package pdsql
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"gorm.io/gorm"
+)
+
+func TestLookupTemplates(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE dns_zone (zone_id INTEGER PRIMARY KEY, zone_name TEXT)`,
+		`CREATE TABLE dns_rr (rr_id INTEGER PRIMARY KEY, zone_id INTEGER, owner TEXT, rtype TEXT, data TEXT, ttl INTEGER)`,
+		`INSERT INTO dns_zone VALUES (7, 'example.org')`,
+		`INSERT INTO dns_rr VALUES (1, 7, 'www.example.org', 'A', '192.168.1.1', 60)`,
+		`INSERT INTO dns_rr VALUES (2, 7, 'alias.example.org', 'CNAME', 'www.example.org', 60)`,
+		`INSERT INTO dns_rr VALUES (3, 7, '*.example.org', 'A', '192.168.1.2', 60)`,
+		`INSERT INTO dns_rr VALUES (4, 7, 'www.example.org', 'TXT', 'hello', 60)`,
+		`INSERT INTO dns_rr VALUES (7, 7, 'txt.example.org', 'TXT', 'no wildcard A', 60)`,
+		`INSERT INTO dns_rr VALUES (8, 7, 'ent.example.org', NULL, NULL, NULL)`,
+		`INSERT INTO dns_rr VALUES (5, 7, 'old.example.org', 'DNAME', 'example.org', 60)`,
+		`INSERT INTO dns_rr VALUES (6, 7, 'www.old.example.org', 'A', '192.168.1.9', 60)`,
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queries := &Queries{}
+	const columns = "rr_id AS id, zone_id AS domain_id, owner AS name, rtype AS type, data AS content, ttl"
+	for kind, query := range map[string]string{
+		"record":   "SELECT " + columns + " FROM dns_rr WHERE owner = @name AND rtype IN @types",
+		"any":      "SELECT " + columns + " FROM dns_rr WHERE owner = @name",
+		"zone":     "SELECT zone_id AS id, zone_name AS name FROM dns_zone WHERE zone_name IN @names",
+		"wildcard": "SELECT " + columns + " FROM dns_rr WHERE zone_id = @domain_id AND owner IN @names",
+		"dname":    "SELECT " + columns + " FROM dns_rr WHERE rtype = 'DNAME' AND owner IN @names",
+	} {
+		if err := queries.Set(kind, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := PowerDNSGenericSQLBackend{DB: db, queries: queries}
+
+	tests := []struct {
+		qname    string
+		qtype    uint16
+		expected []string
+	}{
+		{"www.example.org.", dns.TypeA, []string{"www.example.org A 192.168.1.1"}},
+		{"www.example.org.", dns.TypeANY, []string{"www.example.org A 192.168.1.1", "www.example.org TXT hello"}},
+		{"alias.example.org.", dns.TypeA, []string{"alias.example.org CNAME www.example.org", "www.example.org A 192.168.1.1"}},
+		{"other.example.org.", dns.TypeA, []string{"other.example.org A 192.168.1.2"}},
+		{"txt.example.org.", dns.TypeA, nil},
+		{"ent.example.org.", dns.TypeA, nil},
+		{"www.old.example.org.", dns.TypeA, []string{"old.example.org DNAME example.org", "www.old.example.org CNAME www.example.org", "www.example.org A 192.168.1.1"}},
+		{"old.example.org.", dns.TypeDNAME, []string{"old.example.org DNAME example.org"}},
+		{"example.net.", dns.TypeA, nil},
+	}
+	for _, tc := range tests {
+		records, err := p.Lookup(tc.qname, tc.qtype)
+		if err != nil {
+			t.Fatalf("Lookup %s: %v", tc.qname, err)
+		}
+		var actual []string
+		for _, r := range records {
+			actual = append(actual, fmt.Sprintf("%s %s %s", r.Name, r.Type, r.Content))
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(tc.expected) {
+			t.Errorf("Lookup %s %s: Expected %v, but got %v", tc.qname, dns.TypeToString[tc.qtype], tc.expected, actual)
+		}
+	}
+}
+
+func TestQueriesSet(t *testing.T) {
+	q := DefaultQueries()
+	if err := q.Set("basic", "SELECT 1"); err == nil {
+		t.Error("Expected error for unknown kind")
+	}
+	if err := q.Set("zone", "SELECT id, name FROM domains WHERE name = @name"); err == nil {
+		t.Error("Expected error for unknown parameter")
+	}
+	if err := q.Set("zone", "SELECT id, name FROM domains WHERE name IN @names"); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+}
+
+func TestDefaultQueries(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{DB: db, queries: DefaultQueries()}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`INSERT INTO domains (id, name, type) VALUES (1, 'example.org', 'NATIVE')`,
+		`INSERT INTO records (domain_id, name, type, content, ttl, disabled) VALUES (1, 'www.example.org', 'A', '192.168.1.1', 60, false)`,
+		`INSERT INTO records (domain_id, name, type, content, ttl, disabled) VALUES (1, 'off.example.org', 'A', '192.168.1.3', 60, true)`,
+		`INSERT INTO records (domain_id, name, type, content, ttl, disabled) VALUES (1, '*.example.org', 'A', '192.168.1.2', 60, false)`,
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for qname, expected := range map[string]string{
+		"www.example.org.": "192.168.1.1",
+		"off.example.org.": "192.168.1.2",
+	} {
+		records, err := p.Lookup(qname, dns.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || records[0].Content != expected {
+			t.Errorf("Lookup %s: Expected %s, but got %v", qname, expected, records)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package pdsql
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/miekg/dns"
+)
+
+// ErrMalformedRecord is matched by the errors ToRR returns for rows with malformed content.
+var ErrMalformedRecord = errors.New("malformed record")
+
+// RecordError describes a record row whose content can not be converted to a dns.RR.
+type RecordError struct {
+	ID      uint
+	Name    string
+	Type    string
+	Content string
+	Reason  string
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %d %s %s: %s", e.ID, e.Name, e.Type, e.Reason)
+}
+
+// Is reports whether target is ErrMalformedRecord.
+func (e *RecordError) Is(target error) bool { return target == ErrMalformedRecord }
+
+func malformed(v *pdnsmodel.Record, format string, args ...interface{}) error {
+	return &RecordError{ID: v.ID, Name: v.Name, Type: v.Type, Content: v.Content, Reason: fmt.Sprintf(format, args...)}
+}
+
+// ToRR converts a PowerDNS record row to a dns.RR of the given class. Unsupported types are
+// dropped with a nil RR, malformed content is reported with a *RecordError. ALIAS and LUA rows
+// are converted to the TYPE65401 and TYPE65402 records PowerDNS transfers them as.
+func ToRR(v *pdnsmodel.Record, class uint16) (dns.RR, error) {
+	switch v.Type {
+	case "ALIAS":
+		return aliasRR(v, class)
+	case "LUA":
+		return luaRR(v, class)
+	}
+	typ := dns.StringToType[v.Type]
+	hrd := dns.RR_Header{Name: v.Name, Rrtype: typ, Class: class, Ttl: v.Ttl}
+	if !strings.HasSuffix(hrd.Name, ".") {
+		hrd.Name += "."
+	}
+	newRR, ok := dns.TypeToRR[typ]
+	if !ok {
+		return nil, nil
+	}
+	rr := newRR()
+	// todo support more type
+	// this is enough for most query
+	switch rr := rr.(type) {
+	case *dns.SOA:
+		rr.Hdr = hrd
+		if !ParseSOA(rr, v.Content) {
+			return nil, malformed(v, "invalid SOA content: %s", v.Content)
+		}
+	case *dns.A:
+		rr.Hdr = hrd
+		rr.A = net.ParseIP(v.Content).To4()
+		if rr.A == nil {
+			return nil, malformed(v, "invalid IPv4 address: %s", v.Content)
+		}
+	case *dns.AAAA:
+		rr.Hdr = hrd
+		rr.AAAA = net.ParseIP(v.Content)
+		if rr.AAAA == nil || !strings.Contains(v.Content, ":") {
+			return nil, malformed(v, "invalid IPv6 address: %s", v.Content)
+		}
+	case *dns.TXT:
+		rr.Hdr = hrd
+		txt, err := parseTXT(v.Content)
+		if err != nil {
+			return nil, malformed(v, "invalid TXT content: %s", v.Content)
+		}
+		rr.Txt = txt
+	case *dns.NS:
+		rr.Hdr = hrd
+		if strings.HasSuffix(v.Content, ".") {
+			rr.Ns = v.Content
+		} else {
+			rr.Ns = v.Content + "."
+		}
+	case *dns.PTR:
+		rr.Hdr = hrd
+		// pdns doesn't need the dot but when we answer, we need it
+		if strings.HasSuffix(v.Content, ".") {
+			rr.Ptr = v.Content
+		} else {
+			rr.Ptr = v.Content + "."
+		}
+	case *dns.CNAME:
+		rr.Hdr = hrd
+		if strings.HasSuffix(v.Content, ".") {
+			rr.Target = v.Content
+		} else {
+			rr.Target = v.Content + "."
+		}
+	case *dns.DNAME:
+		rr.Hdr = hrd
+		rr.Target = dns.Fqdn(v.Content)
+
+	case *dns.MX:
+		rr.Hdr = hrd
+
+		// PowerDNS requires for MX Records the Priority to be set
+		if v.Prio != 0 || !strings.Contains(v.Content, " ") {
+			rr.Preference = uint16(v.Prio)
+			if strings.HasSuffix(v.Content, ".") {
+				rr.Mx = v.Content
+			} else {
+				rr.Mx = v.Content + "."
+			}
+		} else {
+			parts := strings.Split(v.Content, " ")
+
+			if len(parts) == 2 {
+				preference, host := parts[0], parts[1]
+				if pref, err := strconv.Atoi(preference); err == nil {
+					rr.Preference = uint16(pref)
+				} else {
+					return nil, malformed(v, "invalid MX preference: %s", preference)
+				}
+				if strings.HasSuffix(host, ".") {
+					rr.Mx = host
+				} else {
+					rr.Mx = host + "."
+				}
+			} else {
+				return nil, malformed(v, "malformed MX record content: %s", v.Content)
+			}
+		}
+
+	case *dns.SRV:
+		rr.Hdr = hrd
+		parts := strings.Split(v.Content, " ")
+		if len(parts) == 3 {
+			// priority kept in the prio column
+			parts = append([]string{strconv.Itoa(v.Prio)}, parts...)
+		}
+		if len(parts) != 4 {
+			return nil, malformed(v, "malformed SRV record content: %s - parts=%d", v.Content, len(parts))
+		}
+		if priority, err := strconv.Atoi(parts[0]); err == nil {
+			rr.Priority = uint16(priority)
+		} else {
+			return nil, malformed(v, "invalid SRV priority: %s", parts[0])
+		}
+		if weight, err := strconv.Atoi(parts[1]); err == nil {
+			rr.Weight = uint16(weight)
+		} else {
+			return nil, malformed(v, "invalid SRV weight: %s", parts[1])
+		}
+		if port, err := strconv.Atoi(parts[2]); err == nil {
+			rr.Port = uint16(port)
+		} else {
+			return nil, malformed(v, "invalid SRV port: %s", parts[2])
+		}
+		rr.Target = dns.Fqdn(parts[3])
+	case *dns.SVCB, *dns.HTTPS:
+		return parseSVCB(v, hrd)
+	default:
+		// drop unsupported
+		return nil, nil
+	}
+
+	return rr, nil
+}
+
+// parseSVCB parses the PowerDNS content of a SVCB or HTTPS record, the SvcPriority, the TargetName
+// and the SvcParams in presentation format like "1 . alpn=h2,h3 ipv4hint=192.0.2.1".
+func parseSVCB(v *pdnsmodel.Record, hdr dns.RR_Header) (dns.RR, error) {
+	rr, err := dns.NewRR(fmt.Sprintf(". 0 IN %s %s", v.Type, v.Content))
+	if err != nil || rr == nil {
+		return nil, malformed(v, "invalid %s content: %s", v.Type, v.Content)
+	}
+	*rr.Header() = hdr
+	return rr, nil
+}
+
+// parseTXT returns the strings of a TXT content. PowerDNS style quoted content like "a" "b" keeps
+// its strings, other content is one text split every 255 bytes.
+func parseTXT(content string) ([]string, error) {
+	if strings.HasPrefix(content, `"`) {
+		rr, err := dns.NewRR(". 0 IN TXT " + content)
+		if err != nil || rr == nil {
+			return nil, fmt.Errorf("invalid TXT content: %s", content)
+		}
+		return rr.(*dns.TXT).Txt, nil
+	}
+	txt := []string{}
+	for len(content) > 255 {
+		txt = append(txt, content[:255])
+		content = content[255:]
+	}
+	return append(txt, content), nil
+}
+
+// FromRR converts rr to a PowerDNS record row, names are stored without the trailing dot
+// and the priority of MX and SRV records is kept in the prio column. TXT content is stored
+// quoted like PowerDNS does.
+func FromRR(rr dns.RR) *pdnsmodel.Record {
+	hdr := rr.Header()
+	r := &pdnsmodel.Record{
+		Name: normalizeName(hdr.Name),
+		Type: dns.TypeToString[hdr.Rrtype],
+		Ttl:  hdr.Ttl,
+	}
+	switch rr := rr.(type) {
+	case *dns.SOA:
+		r.Content = fmt.Sprintf("%s %s %d %d %d %d %d", strings.TrimSuffix(rr.Ns, "."), strings.TrimSuffix(rr.Mbox, "."),
+			rr.Serial, rr.Refresh, rr.Retry, rr.Expire, rr.Minttl)
+	case *dns.A:
+		r.Content = rr.A.String()
+	case *dns.AAAA:
+		r.Content = rr.AAAA.String()
+	case *dns.TXT:
+		// quoted like PowerDNS, keeping the string boundaries
+		r.Content = strings.TrimPrefix(rr.String(), hdr.String())
+	case *dns.NS:
+		r.Content = strings.TrimSuffix(rr.Ns, ".")
+	case *dns.PTR:
+		r.Content = strings.TrimSuffix(rr.Ptr, ".")
+	case *dns.CNAME:
+		r.Content = strings.TrimSuffix(rr.Target, ".")
+	case *dns.DNAME:
+		r.Content = strings.TrimSuffix(rr.Target, ".")
+	case *dns.MX:
+		r.Prio = int(rr.Preference)
+		r.Content = strings.TrimSuffix(rr.Mx, ".")
+	case *dns.SRV:
+		r.Prio = int(rr.Priority)
+		r.Content = fmt.Sprintf("%d %d %s", rr.Weight, rr.Port, strings.TrimSuffix(rr.Target, "."))
+	case *dns.RFC3597:
+		if target, err := aliasTarget(rr); hdr.Rrtype == TypeALIAS && err == nil {
+			r.Type = "ALIAS"
+			r.Content = strings.TrimSuffix(target, ".")
+			break
+		}
+		if content, err := luaContent(rr); hdr.Rrtype == TypeLUA && err == nil {
+			r.Type = "LUA"
+			r.Content = content
+			break
+		}
+		r.Content = strings.TrimPrefix(rr.String(), hdr.String())
+	default:
+		r.Content = strings.TrimPrefix(rr.String(), hdr.String())
+	}
+	return r
+}
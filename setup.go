@@ -1,13 +1,21 @@
 package pdsql
 
 import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/glebarez/sqlite"
 	"github.com/wenerme/coredns-pdsql/pdnsmodel"
-	"log"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -20,7 +28,7 @@ func init() {
 	})
 }
 
-func setup(c *caddy.Controller) error {
+func setup(c *caddy.Controller) (err error) {
 	backend := PowerDNSGenericSQLBackend{}
 	c.Next()
 	if !c.NextArg() {
@@ -33,32 +41,20 @@ func setup(c *caddy.Controller) error {
 	}
 	arg := c.Val()
 
-	var dialector gorm.Dialector
-	switch dialect {
-	case "sqlite":
-		fallthrough
-	case "sqlite3":
-		dialector = sqlite.Open(arg)
-	case "pg":
-		fallthrough
-	case "postgresql":
-		fallthrough
-	case "postgres":
-		dialector = postgres.New(postgres.Config{
-			DSN: arg,
-		})
-	case "mysql":
-		dialector = mysql.Open(arg)
-	default:
-		return plugin.Error("pdsql", c.Errf("unsupported dialect %v", dialect))
-	}
-
-	db, err := gorm.Open(dialector)
+	dialector, err := Dialector(dialect, arg)
 	if err != nil {
-		return err
+		return plugin.Error("pdsql", c.Err(err.Error()))
 	}
-	backend.DB = db
+	backend.zones = plugin.OriginsFromArgsOrServerBlock(nil, c.ServerBlockKeys)
 
+	var debugDB, lazy, fallthroughLazy bool
+	// actions run once the database is reachable
+	var actions []func(db *gorm.DB) error
+	var listenChannel string
+	var api *apiServer
+	healthInterval, healthAddr := defaultHealthInterval, ""
+	checkInterval, checkTimeout, checkAddresses := defaultCheckInterval, defaultCheckTimeout, false
+	queriesSet := map[string]bool{}
 	for c.NextBlock() {
 		x := c.Val()
 		switch x {
@@ -67,16 +63,253 @@ func setup(c *caddy.Controller) error {
 			for _, v := range args {
 				switch v {
 				case "db":
-					backend.DB = backend.DB.Debug()
+					debugDB = true
 				}
 			}
 			backend.Debug = true
-			log.Println(Name, "enable log", args)
+		case "strict":
+			if c.NextArg() {
+				return plugin.Error("pdsql", c.ArgErr())
+			}
+			backend.Strict = true
+		case "lazy-connect":
+			// lazy-connect [fallthrough]
+			args := c.RemainingArgs()
+			switch {
+			case len(args) == 0:
+			case len(args) == 1 && args[0] == "fallthrough":
+				fallthroughLazy = true
+			default:
+				return plugin.Error("pdsql", c.ArgErr())
+			}
+			lazy = true
 		case "auto-migrate":
 			// currently only use records table
-			if err := backend.AutoMigrate(); err != nil {
+			actions = append(actions, func(db *gorm.DB) error {
+				return PowerDNSGenericSQLBackend{DB: db}.AutoMigrate()
+			})
+		case "serve_stale":
+			// serve_stale [DURATION [TTL]]
+			args := c.RemainingArgs()
+			if len(args) > 2 {
+				return plugin.Error("pdsql", c.ArgErr())
+			}
+			window, ttl := defaultStaleWindow, uint32(defaultStaleTTL)
+			if len(args) > 0 {
+				d, err := time.ParseDuration(args[0])
+				if err != nil || d <= 0 {
+					return plugin.Error("pdsql", c.Errf("invalid serve_stale duration '%v'", args[0]))
+				}
+				window = d
+			}
+			if len(args) > 1 {
+				i, err := strconv.ParseUint(args[1], 10, 32)
+				if err != nil {
+					return plugin.Error("pdsql", c.Errf("invalid serve_stale ttl '%v'", args[1]))
+				}
+				ttl = uint32(i)
+			}
+			backend.stale = newStaleCache(window, ttl)
+			if backend.breaker == nil {
+				backend.breaker = newBreaker(defaultBreakerFailures, defaultBreakerProbe)
+			}
+		case "breaker":
+			// breaker [FAILURES [PROBE_INTERVAL]]
+			args := c.RemainingArgs()
+			if len(args) > 2 {
+				return plugin.Error("pdsql", c.ArgErr())
+			}
+			failures, probe := defaultBreakerFailures, defaultBreakerProbe
+			if len(args) > 0 {
+				i, err := strconv.Atoi(args[0])
+				if err != nil || i <= 0 {
+					return plugin.Error("pdsql", c.Errf("invalid breaker failures '%v'", args[0]))
+				}
+				failures = i
+			}
+			if len(args) > 1 {
+				d, err := time.ParseDuration(args[1])
+				if err != nil || d <= 0 {
+					return plugin.Error("pdsql", c.Errf("invalid breaker probe interval '%v'", args[1]))
+				}
+				probe = d
+			}
+			backend.breaker = newBreaker(failures, probe)
+		case "install-triggers":
+			// install-triggers [CHANNEL]
+			channel, err := channelArg(c)
+			if err != nil {
+				return err
+			}
+			actions = append(actions, func(db *gorm.DB) error {
+				return InstallNotifyTriggers(db, channel)
+			})
+		case "listen":
+			// listen [CHANNEL]
+			channel, err := channelArg(c)
+			if err != nil {
 				return err
 			}
+			if dialector.Name() != "postgres" {
+				return plugin.Error("pdsql", c.Errf("listen requires postgres, got %v", dialect))
+			}
+			listenChannel = channel
+		case "record-query", "any-query", "zone-query", "wildcard-query", "dname-query":
+			// record-query SQL
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error("pdsql", c.ArgErr())
+			}
+			if backend.queries == nil {
+				backend.queries = DefaultQueries()
+			}
+			if err := backend.queries.Set(strings.TrimSuffix(x, "-query"), args[0]); err != nil {
+				return plugin.Error("pdsql", c.Err(err.Error()))
+			}
+			queriesSet[x] = true
+		case "api":
+			// api ADDRESS KEY
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return plugin.Error("pdsql", c.ArgErr())
+			}
+			if args[1] == "" {
+				return plugin.Error("pdsql", c.Err("api key must not be empty"))
+			}
+			api = newAPIServer(backend, args[0], args[1])
+		case "health-check":
+			// health-check [INTERVAL [ADDRESS]]
+			args := c.RemainingArgs()
+			if len(args) > 2 {
+				return plugin.Error("pdsql", c.ArgErr())
+			}
+			if len(args) > 0 {
+				d, err := time.ParseDuration(args[0])
+				if err != nil || d <= 0 {
+					return plugin.Error("pdsql", c.Errf("invalid health-check interval '%v'", args[0]))
+				}
+				healthInterval = d
+			}
+			if len(args) > 1 {
+				healthAddr = args[1]
+			}
+		case "check-addresses":
+			// check-addresses [INTERVAL [TIMEOUT]]
+			args := c.RemainingArgs()
+			if len(args) > 2 {
+				return plugin.Error("pdsql", c.ArgErr())
+			}
+			if len(args) > 0 {
+				d, err := time.ParseDuration(args[0])
+				if err != nil || d <= 0 {
+					return plugin.Error("pdsql", c.Errf("invalid check-addresses interval '%v'", args[0]))
+				}
+				checkInterval = d
+			}
+			if len(args) > 1 {
+				d, err := time.ParseDuration(args[1])
+				if err != nil || d <= 0 {
+					return plugin.Error("pdsql", c.Errf("invalid check-addresses timeout '%v'", args[1]))
+				}
+				checkTimeout = d
+			}
+			checkAddresses = true
+		case "order", "max-addresses":
+			// order none|random|round-robin|weighted [ZONES...]
+			// max-addresses N [ZONES...]
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return plugin.Error("pdsql", c.ArgErr())
+			}
+			policy, max := -1, -1
+			if x == "order" {
+				p, ok := orderPolicies[args[0]]
+				if !ok {
+					return plugin.Error("pdsql", c.Errf("unknown order '%v'", args[0]))
+				}
+				policy = p
+			} else {
+				i, err := strconv.Atoi(args[0])
+				if err != nil || i < 0 {
+					return plugin.Error("pdsql", c.Errf("invalid max-addresses '%v'", args[0]))
+				}
+				max = i
+			}
+			if backend.orders == nil {
+				backend.orders = make(map[string]*answerOrder)
+			}
+			for _, zone := range plugin.OriginsFromArgsOrServerBlock(args[1:], c.ServerBlockKeys) {
+				o, ok := backend.orders[zone]
+				if !ok {
+					o = &answerOrder{}
+					backend.orders[zone] = o
+				}
+				if policy >= 0 {
+					o.policy = policy
+				}
+				if max >= 0 {
+					o.max = max
+				}
+			}
+		case "class-policy":
+			// class-policy refuse|notimp|fallthrough
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error("pdsql", c.ArgErr())
+			}
+			policy, ok := classPolicies[args[0]]
+			if !ok {
+				return plugin.Error("pdsql", c.Errf("unknown class-policy '%v'", args[0]))
+			}
+			backend.classPolicy = policy
+		case "chaos":
+			// chaos NAME [TEXT...]
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return plugin.Error("pdsql", c.ArgErr())
+			}
+			name := strings.ToLower(dns.Fqdn(args[0]))
+			txt := args[1:]
+			if len(txt) == 0 {
+				txt = defaultChaosText(name)
+			}
+			if len(txt) == 0 {
+				return plugin.Error("pdsql", c.Errf("chaos name '%v' needs a text", args[0]))
+			}
+			if backend.chaos == nil {
+				backend.chaos = make(map[string][]string)
+			}
+			backend.chaos[name] = txt
+			// CoreDNS refuses CH queries unless a plugin asks for them
+			dnsserver.EnableChaos[Name] = struct{}{}
+		case "any":
+			// any full [udp]|hinfo|one-rrset
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return plugin.Error("pdsql", c.ArgErr())
+			}
+			mode, ok := anyModes[args[0]]
+			if !ok {
+				return plugin.Error("pdsql", c.Errf("unknown any mode '%v'", args[0]))
+			}
+			if len(args) == 2 {
+				if mode != anyFull || args[1] != "udp" {
+					return plugin.Error("pdsql", c.Errf("unexpected any argument '%v'", args[1]))
+				}
+				backend.anyUDP = true
+			}
+			backend.anyMode = mode
+		case "alias-upstream":
+			// alias-upstream ADDRESS...
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return plugin.Error("pdsql", c.ArgErr())
+			}
+			upstreams, err := parse.HostPortOrFile(args...)
+			if err != nil {
+				return plugin.Error("pdsql", c.Err(err.Error()))
+			}
+			backend.alias = newAliasResolver(upstreams)
 		case "driver": // todo
 		case "dialect": // todo
 		case "dsn": // todo
@@ -88,17 +321,153 @@ func setup(c *caddy.Controller) error {
 	if c.NextArg() {
 		return plugin.Error("pdsql", c.ArgErr())
 	}
+	if queriesSet["record-query"] && !queriesSet["dname-query"] {
+		// the default dname query reads the PowerDNS records table the record query replaces
+		backend.queries.DNAME = ""
+		log.Warningf("record-query is set without dname-query, DNAME records are not followed")
+	}
 
-	dnsserver.
-		GetConfig(c).
-		AddPlugin(func(next plugin.Handler) plugin.Handler {
-			backend.Next = next
-			return backend
+	db, err := sharedDBs.Acquire(dialect, arg, lazy)
+	if err != nil {
+		return plugin.Error("pdsql", err)
+	}
+	defer func() {
+		if err != nil {
+			sharedDBs.Release(db)
+		}
+	}()
+	backend.DB = db
+	if debugDB {
+		backend.DB = backend.DB.Debug()
+	}
+
+	if lazy {
+		backend.conn = newConnector(backend.DB, actions, fallthroughLazy)
+		c.OnStartup(backend.conn.Start)
+		c.OnShutdown(backend.conn.Stop)
+	} else {
+		for _, action := range actions {
+			if err := action(backend.DB); err != nil {
+				return plugin.Error("pdsql", err)
+			}
+		}
+	}
+
+	backend.checker = newTargetChecker(checkInterval, checkTimeout)
+	c.OnShutdown(backend.checker.Stop)
+	if checkAddresses {
+		backend.checks = newAddressChecks(backend.DB, backend.checker, checkInterval)
+		c.OnStartup(backend.checks.Start)
+		c.OnShutdown(backend.checks.Stop)
+	}
+
+	backend.health = newHealthProbe(backend.DB, healthInterval, healthAddr)
+	c.OnStartup(backend.health.Start)
+	// the new instance binds the health address before the old one shuts down
+	c.OnRestart(backend.health.Close)
+	c.OnRestartFailed(backend.health.Listen)
+	c.OnShutdown(backend.health.Stop)
+
+	if listenChannel != "" {
+		listener := newChangeListener(backend, arg, listenChannel)
+		c.OnStartup(func() error {
+			if t, ok := dnsserver.GetConfig(c).Handler("transfer").(*transfer.Transfer); ok {
+				listener.transfer = t
+			}
+			return listener.Start()
 		})
+		c.OnShutdown(listener.Stop)
+	}
+
+	if api != nil {
+		// options after the api line must be visible to it
+		api.backend = backend
+		c.OnStartup(func() error {
+			if t, ok := dnsserver.GetConfig(c).Handler("transfer").(*transfer.Transfer); ok {
+				api.transfer = t
+			}
+			return api.Start()
+		})
+		// the new instance binds the address before the old one shuts down
+		c.OnRestart(api.Stop)
+		c.OnRestartFailed(api.Start)
+		c.OnShutdown(api.Stop)
+	}
+
+	config := dnsserver.GetConfig(c)
+	servers := serverAddrs(config)
+	c.OnStartup(func() error {
+		sqlDB, err := backend.DB.DB()
+		if err != nil {
+			return err
+		}
+		for _, server := range servers {
+			pools.Add(server, config.Zone, sqlDB)
+		}
+		return nil
+	})
+	c.OnShutdown(func() error {
+		for _, server := range servers {
+			pools.Remove(server, config.Zone)
+		}
+		return nil
+	})
+
+	// registered last so the pool outlives everything using it
+	c.OnShutdown(func() error { return sharedDBs.Release(db) })
+
+	config.AddPlugin(func(next plugin.Handler) plugin.Handler {
+		backend.Next = next
+		return backend
+	})
 
 	return nil
 }
 
+// Dialector returns the gorm dialector of the bundled drivers for dialect.
+func Dialector(dialect, dsn string) (gorm.Dialector, error) {
+	switch dialect {
+	case "sqlite", "sqlite3":
+		return sqlite.Open(dsn), nil
+	case "pg", "postgresql", "postgres":
+		return postgres.New(postgres.Config{
+			DSN: dsn,
+		}), nil
+	case "mysql":
+		return mysql.Open(dsn), nil
+	default:
+		return nil, fmt.Errorf("unsupported dialect %v", dialect)
+	}
+}
+
+// serverAddrs returns the addresses the servers of config report in their metrics.
+func serverAddrs(config *dnsserver.Config) []string {
+	var addrs []string
+	for _, h := range config.ListenHosts {
+		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(h, config.Port))
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, config.Transport+"://"+addr.String())
+	}
+	return addrs
+}
+
+func channelArg(c *caddy.Controller) (string, error) {
+	args := c.RemainingArgs()
+	switch len(args) {
+	case 0:
+		return DefaultNotifyChannel, nil
+	case 1:
+		if !channelPattern.MatchString(args[0]) {
+			return "", plugin.Error("pdsql", c.Errf("invalid channel '%v'", args[0]))
+		}
+		return args[0], nil
+	default:
+		return "", plugin.Error("pdsql", c.ArgErr())
+	}
+}
+
 func (pdb PowerDNSGenericSQLBackend) AutoMigrate() error {
-	return pdb.DB.AutoMigrate(&pdnsmodel.Domain{}, &pdnsmodel.Record{})
+	return pdb.DB.AutoMigrate(&pdnsmodel.Domain{}, &pdnsmodel.Record{}, &pdnsmodel.Comment{})
 }
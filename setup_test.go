@@ -1,20 +1,40 @@
 package pdsql
 
 import (
+	"reflect"
 	"testing"
+	"unsafe"
 
 	"github.com/coredns/caddy"
 )
 
+// setupTest runs setup and the shutdown callbacks it registered when the test ends, so the
+// shared pools and pool metrics are released like on a real shutdown.
+func setupTest(t *testing.T, c *caddy.Controller) error {
+	if err := setup(c); err != nil {
+		return err
+	}
+	// the test controller keeps its instance unexported
+	instance := (*caddy.Instance)(unsafe.Pointer(reflect.ValueOf(c).Elem().FieldByName("instance").Pointer()))
+	t.Cleanup(func() {
+		for _, fn := range instance.OnShutdown {
+			if err := fn(); err != nil {
+				t.Errorf("Expected no shutdown errors, but got: %v", err)
+			}
+		}
+	})
+	return nil
+}
+
 func TestSetupPdsql(t *testing.T) {
 	c := caddy.NewTestController("dns", `pdsql sqlite3 :memory:`)
-	if err := setup(c); err != nil {
+	if err := setupTest(t, c); err != nil {
 		t.Fatalf("Expected no errors, but got: %v", err)
 	}
 
 	c = caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
 }`)
-	if err := setup(c); err != nil {
+	if err := setupTest(t, c); err != nil {
 		t.Fatalf("Expected no errors, but got: %v", err)
 	}
 
@@ -22,19 +42,19 @@ func TestSetupPdsql(t *testing.T) {
 debug db
 auto-migrate
 }`)
-	if err := setup(c); err != nil {
+	if err := setupTest(t, c); err != nil {
 		t.Fatalf("Expected no errors, but got: %v", err)
 	}
 
 	c = caddy.NewTestController("dns", `pdsql sqlite`)
-	if err := setup(c); err == nil {
+	if err := setupTest(t, c); err == nil {
 		t.Fatalf("Expected errors, but got: %v", err)
 	}
 
 	c = caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
 unknown
 }`)
-	if err := setup(c); err == nil {
+	if err := setupTest(t, c); err == nil {
 		t.Fatalf("Expected errors, but got: %v", err)
 	}
 
@@ -42,21 +62,342 @@ unknown
 debug
 unknown
 }`)
-	if err := setup(c); err == nil {
+	if err := setupTest(t, c); err == nil {
 		t.Fatalf("Expected errors, but got: %v", err)
 	}
 
 	c = caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
 debug
 } invalid`)
-	if err := setup(c); err == nil {
+	if err := setupTest(t, c); err == nil {
 		t.Fatalf("Expected errors, but got: %v", err)
 	}
 
 	c = caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
 auto-migrate invalid
 }`)
-	if err := setup(c); err == nil {
+	if err := setupTest(t, c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+}
+
+func TestSetupServeStale(t *testing.T) {
+	c := caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
+serve_stale 10m 60
+breaker 3 10s
+}`)
+	if err := setupTest(t, c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, input := range []string{
+		`pdsql sqlite3 :memory: {
+serve_stale invalid
+}`,
+		`pdsql sqlite3 :memory: {
+serve_stale 10m -1
+}`,
+		`pdsql sqlite3 :memory: {
+serve_stale 10m 60 extra
+}`,
+		`pdsql sqlite3 :memory: {
+breaker 0
+}`,
+		`pdsql sqlite3 :memory: {
+breaker 3 invalid
+}`,
+	} {
+		c = caddy.NewTestController("dns", input)
+		if err := setupTest(t, c); err == nil {
+			t.Fatalf("Expected errors for %q, but got: %v", input, err)
+		}
+	}
+}
+
+func TestSetupListen(t *testing.T) {
+	for _, input := range []string{
+		`pdsql sqlite3 :memory: {
+listen
+}`,
+		`pdsql sqlite3 :memory: {
+install-triggers
+}`,
+		`pdsql sqlite3 :memory: {
+install-triggers Invalid-Channel
+}`,
+	} {
+		c := caddy.NewTestController("dns", input)
+		if err := setupTest(t, c); err == nil {
+			t.Fatalf("Expected errors for %q, but got: %v", input, err)
+		}
+	}
+}
+
+func TestSetupQueries(t *testing.T) {
+	c := caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
+record-query "SELECT id, domain_id, name, type, content, ttl, prio FROM records_view WHERE name = @name AND type IN @types"
+}`)
+	if err := setupTest(t, c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	c = caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
+record-query "SELECT id, domain_id, name, type, content, ttl, prio FROM records_view WHERE name = @name AND type IN @types"
+dname-query "SELECT id, domain_id, name, type, content, ttl, prio FROM records_view WHERE type = 'DNAME' AND name IN @names"
+}`)
+	if err := setupTest(t, c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, input := range []string{
+		`pdsql sqlite3 :memory: {
+record-query
+}`,
+		`pdsql sqlite3 :memory: {
+zone-query "SELECT id, name FROM domains WHERE name = @qname"
+}`,
+		`pdsql sqlite3 :memory: {
+dname-query "SELECT id, domain_id, name, type, content, ttl, prio FROM records WHERE name = @name"
+}`,
+	} {
+		c = caddy.NewTestController("dns", input)
+		if err := setupTest(t, c); err == nil {
+			t.Fatalf("Expected errors for %q, but got: %v", input, err)
+		}
+	}
+}
+
+func TestSetupAPI(t *testing.T) {
+	c := caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
+api 127.0.0.1:8081 secret
+}`)
+	if err := setupTest(t, c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
+api 127.0.0.1:8081
+}`)
+	if err := setupTest(t, c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+}
+
+func TestSetupStrict(t *testing.T) {
+	c := caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
+strict
+}`)
+	if err := setupTest(t, c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
+strict yes
+}`)
+	if err := setupTest(t, c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+}
+
+func TestSetupHealthCheck(t *testing.T) {
+	for _, input := range []string{
+		`pdsql sqlite3 :memory: {
+health-check
+}`,
+		`pdsql sqlite3 :memory: {
+health-check 5s
+}`,
+		`pdsql sqlite3 :memory: {
+health-check 5s 127.0.0.1:8082
+}`,
+	} {
+		c := caddy.NewTestController("dns", input)
+		if err := setupTest(t, c); err != nil {
+			t.Fatalf("Expected no errors, but got: %v", err)
+		}
+	}
+
+	for _, input := range []string{
+		`pdsql sqlite3 :memory: {
+health-check never
+}`,
+		`pdsql sqlite3 :memory: {
+health-check 5s 127.0.0.1:8082 extra
+}`,
+	} {
+		c := caddy.NewTestController("dns", input)
+		if err := setupTest(t, c); err == nil {
+			t.Fatalf("Expected errors, but got: %v", err)
+		}
+	}
+}
+
+func TestSetupLazyConnect(t *testing.T) {
+	for _, input := range []string{
+		`pdsql sqlite3 :memory: {
+lazy-connect
+auto-migrate
+}`,
+		`pdsql sqlite3 :memory: {
+lazy-connect fallthrough
+}`,
+	} {
+		c := caddy.NewTestController("dns", input)
+		if err := setupTest(t, c); err != nil {
+			t.Fatalf("Expected no errors, but got: %v", err)
+		}
+	}
+
+	c := caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
+lazy-connect always
+}`)
+	if err := setupTest(t, c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+}
+
+func TestSetupClass(t *testing.T) {
+	c := caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
+class-policy notimp
+chaos version.bind
+chaos id.server ns1.example.org
+}`)
+	if err := setupTest(t, c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, input := range []string{
+		`pdsql sqlite3 :memory: {
+class-policy drop
+}`,
+		`pdsql sqlite3 :memory: {
+chaos
+}`,
+		`pdsql sqlite3 :memory: {
+chaos authors.bind
+}`,
+	} {
+		c := caddy.NewTestController("dns", input)
+		if err := setupTest(t, c); err == nil {
+			t.Fatalf("Expected errors, but got: %v", err)
+		}
+	}
+}
+
+func TestSetupANY(t *testing.T) {
+	for _, input := range []string{
+		`pdsql sqlite3 :memory: {
+any full udp
+}`,
+		`pdsql sqlite3 :memory: {
+any hinfo
+}`,
+		`pdsql sqlite3 :memory: {
+any one-rrset
+}`,
+	} {
+		c := caddy.NewTestController("dns", input)
+		if err := setupTest(t, c); err != nil {
+			t.Fatalf("Expected no errors, but got: %v", err)
+		}
+	}
+
+	for _, input := range []string{
+		`pdsql sqlite3 :memory: {
+any
+}`,
+		`pdsql sqlite3 :memory: {
+any none
+}`,
+		`pdsql sqlite3 :memory: {
+any hinfo udp
+}`,
+	} {
+		c := caddy.NewTestController("dns", input)
+		if err := setupTest(t, c); err == nil {
+			t.Fatalf("Expected errors, but got: %v", err)
+		}
+	}
+}
+
+func TestSetupAlias(t *testing.T) {
+	c := caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
+alias-upstream 8.8.8.8 [2001:4860:4860::8888]:53
+}`)
+	if err := setupTest(t, c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
+alias-upstream
+}`)
+	if err := setupTest(t, c); err == nil {
 		t.Fatalf("Expected errors, but got: %v", err)
 	}
 }
+
+func TestSetupCheckAddresses(t *testing.T) {
+	c := caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
+check-addresses 10s 1s
+}`)
+	if err := setupTest(t, c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, input := range []string{
+		`pdsql sqlite3 :memory: {
+check-addresses never
+}`,
+		`pdsql sqlite3 :memory: {
+check-addresses 10s 0s
+}`,
+	} {
+		c := caddy.NewTestController("dns", input)
+		if err := setupTest(t, c); err == nil {
+			t.Fatalf("Expected errors, but got: %v", err)
+		}
+	}
+}
+
+func TestSetupOrder(t *testing.T) {
+	c := caddy.NewTestController("dns", `pdsql sqlite3 :memory: {
+order round-robin
+order weighted example.net
+max-addresses 2 example.net
+}`)
+	if err := setupTest(t, c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, input := range []string{
+		`pdsql sqlite3 :memory: {
+order
+}`,
+		`pdsql sqlite3 :memory: {
+order fastest
+}`,
+		`pdsql sqlite3 :memory: {
+max-addresses -1
+}`,
+	} {
+		c := caddy.NewTestController("dns", input)
+		if err := setupTest(t, c); err == nil {
+			t.Fatalf("Expected errors, but got: %v", err)
+		}
+	}
+}
+
+func TestSetupShutdown(t *testing.T) {
+	dsn := "file:setup-shutdown?mode=memory&cache=shared"
+	t.Run("setup", func(t *testing.T) {
+		c := caddy.NewTestController("dns", `pdsql sqlite3 `+dsn)
+		if err := setupTest(t, c); err != nil {
+			t.Fatalf("Expected no errors, but got: %v", err)
+		}
+	})
+	sharedDBs.mu.Lock()
+	_, ok := sharedDBs.dbs[dbKey{dialect: "sqlite", dsn: dsn}]
+	sharedDBs.mu.Unlock()
+	if ok {
+		t.Error("Expected the pool to be released after shutdown")
+	}
+}
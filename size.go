@@ -0,0 +1,55 @@
+package pdsql
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// writeMsg writes the answer a to the request, with the EDNS OPT record when the query had one
+// and reduced to the size the client accepts.
+func writeMsg(state request.Request, a *dns.Msg) error {
+	state.SizeAndDo(a)
+	fitSize(a, state.Size())
+	return state.W.WriteMsg(a)
+}
+
+// fitSize drops whole RRsets from the end of the message until it fits in size bytes. Additional
+// records are dropped silently, dropping authority or answer records sets TC as in RFC 2181 section 9.
+func fitSize(m *dns.Msg, size int) {
+	for m.Len() > size {
+		var ok bool
+		if m.Extra, ok = dropLastRRset(m.Extra); ok {
+			continue
+		}
+		if m.Ns, ok = dropLastRRset(m.Ns); !ok {
+			if m.Answer, ok = dropLastRRset(m.Answer); !ok {
+				return
+			}
+		}
+		m.Truncated = true
+	}
+}
+
+// dropLastRRset removes the RRset of the last record from rrs, the EDNS OPT record is kept.
+// It reports whether anything was removed.
+func dropLastRRset(rrs []dns.RR) ([]dns.RR, bool) {
+	var last *dns.RR_Header
+	for i := len(rrs) - 1; i >= 0 && last == nil; i-- {
+		if hdr := rrs[i].Header(); hdr.Rrtype != dns.TypeOPT {
+			last = hdr
+		}
+	}
+	if last == nil {
+		return rrs, false
+	}
+
+	var out []dns.RR
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == last.Rrtype && hdr.Class == last.Class && equal(hdr.Name, last.Name) {
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out, true
+}
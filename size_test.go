@@ -0,0 +1,89 @@
+package pdsql
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+func TestServeSize(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{DB: db}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&pdnsmodel.Record{Name: "example.org", Type: "A", Content: "192.168.1.1", Ttl: 3600}).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		r := pdnsmodel.Record{Name: "example.org", Type: "TXT", Content: fmt.Sprintf("%d%s", i, strings.Repeat("x", 99)), Ttl: 3600}
+		if err := db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := func(qtype uint16, bufsize uint16, tcp bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", qtype)
+		if bufsize != 0 {
+			req.SetEdns0(bufsize, false)
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: tcp})
+		if _, err := p.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		return rec.Msg
+	}
+
+	msg := query(dns.TypeTXT, 0, false)
+	if !msg.Truncated || len(msg.Answer) != 0 || msg.IsEdns0() != nil {
+		t.Errorf("Expected the TXT RRset dropped with TC over UDP, but got %v", msg)
+	}
+	if msg.Len() > dns.MinMsgSize {
+		t.Errorf("Expected at most %d bytes, but got %d", dns.MinMsgSize, msg.Len())
+	}
+
+	msg = query(dns.TypeTXT, 4096, false)
+	if msg.Truncated || len(msg.Answer) != 10 {
+		t.Errorf("Expected the whole TXT RRset with EDNS, but got %v", msg)
+	}
+	if opt := msg.IsEdns0(); opt == nil || opt.UDPSize() != 4096 {
+		t.Errorf("Expected an OPT record with size 4096, but got %v", opt)
+	}
+
+	if msg = query(dns.TypeTXT, 0, true); msg.Truncated || len(msg.Answer) != 10 {
+		t.Errorf("Expected the whole TXT RRset over TCP, but got %v", msg)
+	}
+
+	p.anyUDP = true
+	msg = query(dns.TypeANY, 0, false)
+	if !msg.Truncated || len(msg.Answer) != 1 || msg.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("Expected only the A RRset with TC, but got %v", msg)
+	}
+}
+
+func TestFitSize(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeMX)
+	m.Answer = []dns.RR{test.MX("example.org. 3600 IN MX 10 mail.example.org.")}
+	m.Extra = []dns.RR{test.A("mail.example.org. 3600 IN A 192.168.1.1"), test.A("mail.example.org. 3600 IN A 192.168.1.2")}
+	m.SetEdns0(dns.MinMsgSize, false)
+
+	size := m.Len() - 1
+	fitSize(m, size)
+	if m.Truncated || len(m.Answer) != 1 || len(m.Extra) != 1 || m.IsEdns0() == nil {
+		t.Errorf("Expected the additional A RRset dropped without TC, but got %v", m)
+	}
+}
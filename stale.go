@@ -0,0 +1,195 @@
+package pdsql
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"gorm.io/gorm"
+)
+
+// ErrBreakerOpen is returned instead of querying the database while the circuit breaker is open.
+var ErrBreakerOpen = errors.New("pdsql: database circuit breaker is open")
+
+const (
+	defaultStaleWindow  = time.Hour
+	defaultStaleTTL     = 30
+	defaultStaleEntries = 10000
+
+	defaultBreakerFailures = 5
+	defaultBreakerProbe    = 5 * time.Second
+)
+
+// staleCache keeps the last successful answer of every question so it can be served
+// while the database is unavailable.
+type staleCache struct {
+	mu         sync.RWMutex
+	entries    map[staleKey]staleEntry
+	window     time.Duration
+	ttl        uint32
+	maxEntries int
+	now        func() time.Time
+}
+
+type staleKey struct {
+	qname string
+	qtype uint16
+}
+
+type staleEntry struct {
+	rcode  int
+	answer []dns.RR
+	extra  []dns.RR
+	stored time.Time
+}
+
+func newStaleCache(window time.Duration, ttl uint32) *staleCache {
+	return &staleCache{
+		entries:    make(map[staleKey]staleEntry),
+		window:     window,
+		ttl:        ttl,
+		maxEntries: defaultStaleEntries,
+		now:        time.Now,
+	}
+}
+
+func (s *staleCache) key(qname string, qtype uint16) staleKey {
+	return staleKey{qname: strings.ToLower(dns.Fqdn(qname)), qtype: qtype}
+}
+
+// Store remembers a successful answer.
+func (s *staleCache) Store(qname string, qtype uint16, m *dns.Msg) {
+	if s == nil {
+		return
+	}
+	e := staleEntry{rcode: m.Rcode, stored: s.now()}
+	for _, rr := range m.Answer {
+		e.answer = append(e.answer, dns.Copy(rr))
+	}
+	for _, rr := range m.Extra {
+		e.extra = append(e.extra, dns.Copy(rr))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.key(qname, qtype)
+	if _, ok := s.entries[k]; !ok && len(s.entries) >= s.maxEntries {
+		// drop any entry, the cache only needs to survive a database outage
+		for dk := range s.entries {
+			delete(s.entries, dk)
+			break
+		}
+	}
+	s.entries[k] = e
+}
+
+// Lookup fills m with the stale answer for the question, the ttl of every record is capped to the stale ttl.
+func (s *staleCache) Lookup(qname string, qtype uint16, m *dns.Msg) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.RLock()
+	e, ok := s.entries[s.key(qname, qtype)]
+	s.mu.RUnlock()
+	if !ok || s.now().Sub(e.stored) > s.window {
+		return false
+	}
+	m.Rcode = e.rcode
+	m.Answer = s.copy(e.answer)
+	m.Extra = s.copy(e.extra)
+	return true
+}
+
+func (s *staleCache) copy(rrs []dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		if rr.Header().Ttl > s.ttl {
+			rr.Header().Ttl = s.ttl
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// breaker stops querying a dead database after a number of consecutive failures,
+// one request per probe interval pings the database to check whether it came back.
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	threshold int
+	probe     time.Duration
+	openUntil time.Time
+	now       func() time.Time
+}
+
+func newBreaker(threshold int, probe time.Duration) *breaker {
+	return &breaker{threshold: threshold, probe: probe, now: time.Now}
+}
+
+// Allow reports whether the database may be queried, the probe ping is bounded by ctx and the health timeout.
+func (b *breaker) Allow(ctx context.Context, db *gorm.DB) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	if b.failures < b.threshold {
+		b.mu.Unlock()
+		return true
+	}
+	now := b.now()
+	if now.Before(b.openUntil) {
+		b.mu.Unlock()
+		return false
+	}
+	// this request is the probe, others keep failing fast until it finishes
+	b.openUntil = now.Add(b.probe)
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	if sqlDB, err := db.DB(); err != nil || sqlDB.PingContext(ctx) != nil {
+		return false
+	}
+	b.Success()
+	return true
+}
+
+func (b *breaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.failures = 0
+	b.mu.Unlock()
+}
+
+func (b *breaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.failures++
+	if b.failures == b.threshold {
+		b.openUntil = b.now().Add(b.probe)
+	}
+	b.mu.Unlock()
+}
+
+// Purge drops the entries at and below zone, an empty zone drops everything.
+func (s *staleCache) Purge(zone string) {
+	if s == nil {
+		return
+	}
+	zone = strings.ToLower(dns.Fqdn(zone))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k := range s.entries {
+		if zone == "." || dns.IsSubDomain(zone, k.qname) {
+			delete(s.entries, k)
+		}
+	}
+}
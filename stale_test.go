@@ -0,0 +1,133 @@
+package pdsql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+func TestServeStale(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := PowerDNSGenericSQLBackend{DB: db, stale: newStaleCache(time.Minute, 30), breaker: newBreaker(2, time.Hour)}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DB.Create(&pdnsmodel.Record{Name: "stale.example.org", Type: "A", Content: "192.168.1.1", Ttl: 3600}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("stale.example.org.", dns.TypeA)
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if code, err := p.ServeDNS(context.TODO(), rec, req); err != nil || code != dns.RcodeSuccess {
+		t.Fatalf("Expected success, but got code %d err %v", code, err)
+	}
+	if ttl := rec.Msg.Answer[0].Header().Ttl; ttl != 3600 {
+		t.Fatalf("Expected fresh ttl 3600, but got %d", ttl)
+	}
+
+	sqlDB, _ := p.DB.DB()
+	sqlDB.Close()
+
+	for i := 0; i < 3; i++ {
+		rec = dnstest.NewRecorder(&test.ResponseWriter{})
+		code, err := p.ServeDNS(context.TODO(), rec, req)
+		if err != nil || code != dns.RcodeSuccess {
+			t.Fatalf("Expected stale answer, but got code %d err %v", code, err)
+		}
+		if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].Header().Ttl != 30 {
+			t.Fatalf("Expected one stale record with ttl 30, but got %v", rec.Msg.Answer)
+		}
+	}
+
+	req.SetQuestion("Stale.Example.ORG.", dns.TypeA)
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := p.ServeDNS(context.TODO(), rec, req); err != nil || rec.Msg.Answer[0].Header().Name != "Stale.Example.ORG." {
+		t.Fatalf("Expected stale answer with the question's case, but got %v err %v", rec.Msg, err)
+	}
+
+	req.SetQuestion("missing.example.org.", dns.TypeA)
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	if code, err := p.ServeDNS(context.TODO(), rec, req); err != ErrBreakerOpen || code != dns.RcodeServerFailure {
+		t.Fatalf("Expected SERVFAIL with open breaker, but got code %d err %v", code, err)
+	}
+}
+
+func TestStaleCacheExpire(t *testing.T) {
+	now := time.Now()
+	s := newStaleCache(time.Minute, 30)
+	s.now = func() time.Time { return now }
+
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{test.A("example.org. 10 IN A 192.168.1.1")}
+	s.Store("Example.ORG.", dns.TypeA, m)
+
+	out := new(dns.Msg)
+	if !s.Lookup("example.org.", dns.TypeA, out) {
+		t.Fatal("Expected stale entry")
+	}
+	if ttl := out.Answer[0].Header().Ttl; ttl != 10 {
+		t.Errorf("Expected ttl below stale ttl to be kept, but got %d", ttl)
+	}
+
+	m = new(dns.Msg)
+	m.Rcode = dns.RcodeYXDomain
+	m.Answer = []dns.RR{test.CNAME("www.example.org. 10 IN CNAME www.example.net.")}
+	s.Store("www.example.org.", dns.TypeA, m)
+	out = new(dns.Msg)
+	if !s.Lookup("www.example.org.", dns.TypeA, out) || out.Rcode != dns.RcodeYXDomain {
+		t.Errorf("Expected the stored rcode YXDOMAIN, but got %s", dns.RcodeToString[out.Rcode])
+	}
+
+	now = now.Add(2 * time.Minute)
+	if s.Lookup("example.org.", dns.TypeA, out) {
+		t.Error("Expected stale entry to expire after the window")
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	b := newBreaker(2, time.Second)
+	b.now = func() time.Time { return now }
+
+	b.Failure()
+	if !b.Allow(context.TODO(), db) {
+		t.Fatal("Expected breaker to stay closed below the threshold")
+	}
+	b.Failure()
+	if b.Allow(context.TODO(), db) {
+		t.Fatal("Expected breaker to open at the threshold")
+	}
+
+	now = now.Add(2 * time.Second)
+	if !b.Allow(context.TODO(), db) {
+		t.Fatal("Expected successful probe to close the breaker")
+	}
+
+	b.Failure()
+	b.Failure()
+	sqlDB, _ := db.DB()
+	sqlDB.Close()
+	now = now.Add(2 * time.Second)
+	if b.Allow(context.TODO(), db) {
+		t.Fatal("Expected failed probe to keep the breaker open")
+	}
+}
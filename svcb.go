@@ -0,0 +1,84 @@
+package pdsql
+
+import (
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// svcbTarget returns the SVCB record of rr, nil when rr is neither SVCB nor HTTPS.
+func svcbTarget(rr dns.RR) *dns.SVCB {
+	switch rr := rr.(type) {
+	case *dns.SVCB:
+		return rr
+	case *dns.HTTPS:
+		return &rr.SVCB
+	}
+	return nil
+}
+
+// svcbAdditional returns the additional records of the SVCB and HTTPS records in answer as in
+// RFC 9460 section 4.1. AliasMode targets are chased for their SVCB records, the A and AAAA
+// records are added for AliasMode targets and for ServiceMode targets inside zone.
+// Additional records are optional, failed lookups are skipped.
+func (pdb PowerDNSGenericSQLBackend) svcbAdditional(ctx context.Context, zone string, answer []dns.RR) []dns.RR {
+	pdb.DB = pdb.DB.WithContext(ctx)
+
+	var extra []dns.RR
+	seen := map[string]bool{}
+	key := func(name string, qtype uint16) string {
+		return normalizeName(name) + "/" + dns.TypeToString[qtype]
+	}
+	for _, rr := range answer {
+		seen[key(rr.Header().Name, rr.Header().Rrtype)] = true
+	}
+	add := func(name string, qtype uint16) []dns.RR {
+		if seen[key(name, qtype)] {
+			return nil
+		}
+		seen[key(name, qtype)] = true
+		records, _, err := pdb.lookup(name, qtype)
+		if err != nil {
+			return nil
+		}
+		var rrs []dns.RR
+		for _, v := range records {
+			if v.Type != dns.TypeToString[qtype] || v.Name != normalizeName(name) {
+				// CNAMEs of the target are not followed in the additional section
+				continue
+			}
+			if rr, err := ToRR(v, dns.ClassINET); err == nil && rr != nil {
+				rrs = append(rrs, rr)
+			}
+		}
+		extra = append(extra, rrs...)
+		return rrs
+	}
+
+	queue := answer
+	for hop := 0; len(queue) != 0 && hop <= maxChainLength; hop++ {
+		var next []dns.RR
+		for _, rr := range queue {
+			svcb := svcbTarget(rr)
+			if svcb == nil {
+				continue
+			}
+			target := svcb.Target
+			if target == "." {
+				if svcb.Priority == 0 {
+					// AliasMode to "." means the service is not available
+					continue
+				}
+				target = svcb.Hdr.Name
+			}
+			if svcb.Priority == 0 {
+				next = append(next, add(target, svcb.Hdr.Rrtype)...)
+			} else if zone == "" || !dns.IsSubDomain(zone, target) {
+				continue
+			}
+			add(target, dns.TypeA)
+			add(target, dns.TypeAAAA)
+		}
+		queue = next
+	}
+	return extra
+}
@@ -0,0 +1,75 @@
+package pdsql
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+func TestServeSVCB(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{DB: db, zones: []string{"example.org."}}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []pdnsmodel.Record{
+		{Name: "example.org", Type: "HTTPS", Content: "0 svc.example.org", Ttl: 3600},
+		{Name: "svc.example.org", Type: "HTTPS", Content: "1 . alpn=h2,h3 ipv4hint=192.0.2.1 ech=AEX+DQBBpQAgACB/RHnKSdjN/qGDG1FZZB1v8XqZmJvOZ5OiO4JRUHZnMQAEAAEAAQASY2xvdWRmbGFyZS1lY2guY29tAAA=", Ttl: 3600},
+		{Name: "svc.example.org", Type: "A", Content: "192.0.2.1", Ttl: 3600},
+		{Name: "svc.example.org", Type: "AAAA", Content: "2001:db8::1", Ttl: 3600},
+		{Name: "_dns.example.org", Type: "SVCB", Content: "1 dns.example.net. alpn=dot port=853", Ttl: 3600},
+	} {
+		if err := db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := p.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatalf("Expected no error for %s, but got %v", name, err)
+		}
+		return rec.Msg
+	}
+
+	msg := query("example.org.", dns.TypeHTTPS)
+	if len(msg.Answer) != 1 {
+		t.Fatalf("Expected one HTTPS answer, but got %v", msg.Answer)
+	}
+	if https, ok := msg.Answer[0].(*dns.HTTPS); !ok || https.Priority != 0 || https.Target != "svc.example.org." {
+		t.Errorf("Expected HTTPS AliasMode to svc.example.org., but got %v", msg.Answer[0])
+	}
+	if len(msg.Extra) != 3 {
+		t.Fatalf("Expected the HTTPS, A and AAAA records of the target, but got %v", msg.Extra)
+	}
+	https, ok := msg.Extra[0].(*dns.HTTPS)
+	if !ok || https.Priority != 1 || len(https.Value) != 3 {
+		t.Errorf("Expected HTTPS ServiceMode with 3 params, but got %v", msg.Extra[0])
+	}
+	if msg.Extra[1].Header().Rrtype != dns.TypeA || msg.Extra[2].Header().Rrtype != dns.TypeAAAA {
+		t.Errorf("Expected A and AAAA of svc.example.org., but got %v", msg.Extra[1:])
+	}
+
+	msg = query("_dns.example.org.", dns.TypeSVCB)
+	if len(msg.Answer) != 1 || len(msg.Extra) != 0 {
+		t.Errorf("Expected SVCB without additional records for an out of zone target, but got %v", msg)
+	}
+
+	bad := &pdnsmodel.Record{Name: "bad.example.org", Type: "HTTPS", Content: "1 . nokey=x", Ttl: 3600}
+	if _, err := ToRR(bad, dns.ClassINET); !errors.Is(err, ErrMalformedRecord) {
+		t.Errorf("Expected a malformed HTTPS record, but got %v", err)
+	}
+}
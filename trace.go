@@ -0,0 +1,55 @@
+package pdsql
+
+import (
+	"context"
+
+	ot "github.com/opentracing/opentracing-go"
+	otext "github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"gorm.io/gorm"
+)
+
+const querySpanKey = "pdsql:query_span"
+
+// startSpan starts a child of the span in ctx, it returns a nil span when the request is not traced.
+func startSpan(ctx context.Context, name string) (ot.Span, context.Context) {
+	if ctx == nil {
+		return nil, ctx
+	}
+	span := ot.SpanFromContext(ctx)
+	if span == nil {
+		return nil, ctx
+	}
+	child := span.Tracer().StartSpan(name, ot.ChildOf(span.Context()))
+	return child, ot.ContextWithSpan(ctx, child)
+}
+
+// startQuerySpan starts a span for the statement when the request running it is traced.
+func startQuerySpan(db *gorm.DB) {
+	span, _ := startSpan(db.Statement.Context, "sql "+kindFrom(db.Statement.Context))
+	if span != nil {
+		db.InstanceSet(querySpanKey, span)
+	}
+}
+
+// finishQuerySpan tags the span of the statement with its kind, SQL and outcome, rows are only
+// known when gorm scanned them in the callback.
+func finishQuerySpan(db *gorm.DB, rows bool) {
+	v, ok := db.InstanceGet(querySpanKey)
+	if !ok {
+		return
+	}
+	span := v.(ot.Span)
+	defer span.Finish()
+
+	otext.DBType.Set(span, "sql")
+	otext.DBStatement.Set(span, db.Statement.SQL.String())
+	span.SetTag("pdsql.kind", kindFrom(db.Statement.Context))
+	if rows {
+		span.SetTag("pdsql.rows", db.Statement.RowsAffected)
+	}
+	if db.Error != nil {
+		otext.Error.Set(span, true)
+		span.LogFields(otlog.Error(db.Error))
+	}
+}
@@ -0,0 +1,83 @@
+package pdsql
+
+import (
+	"testing"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+func TestTraceSpans(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registerCallbacks(db); err != nil {
+		t.Fatal(err)
+	}
+	p := PowerDNSGenericSQLBackend{DB: db}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	domain := pdnsmodel.Domain{Name: "trace.example", Type: "NATIVE"}
+	if err := db.Create(&domain).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []pdnsmodel.Record{
+		{DomainId: domain.ID, Name: "www.trace.example", Type: "CNAME", Content: "web.trace.example", Ttl: 300},
+		{DomainId: domain.ID, Name: "*.trace.example", Type: "A", Content: "192.168.1.1", Ttl: 300},
+	} {
+		if err := db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracer := mocktracer.New()
+	root := tracer.StartSpan("pdsql")
+	ctx := ot.ContextWithSpan(context.TODO(), root)
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.trace.example.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if code, err := p.ServeDNS(ctx, rec, req); err != nil || code != dns.RcodeSuccess {
+		t.Fatalf("Expected success, but got code %d err %v", code, err)
+	}
+	root.Finish()
+
+	spans := map[string]*mocktracer.MockSpan{}
+	for _, s := range tracer.FinishedSpans() {
+		spans[s.OperationName] = s
+	}
+	rootID := root.Context().(mocktracer.MockSpanContext).SpanID
+
+	lookup, cname, sql := spans["lookup"], spans["cname"], spans["sql lookup"]
+	if lookup == nil || cname == nil || sql == nil {
+		t.Fatalf("Expected lookup, cname and sql lookup spans, but got %v", tracer.FinishedSpans())
+	}
+	if lookup.ParentID != rootID || cname.ParentID != rootID {
+		t.Errorf("Expected lookup spans to be children of the request span")
+	}
+	if sql.ParentID != lookup.SpanContext.SpanID && sql.ParentID != cname.SpanContext.SpanID {
+		t.Errorf("Expected sql span to be a child of a lookup span, but got parent %d", sql.ParentID)
+	}
+	if kind := sql.Tag("pdsql.kind"); kind != "lookup" {
+		t.Errorf("Expected sql span kind lookup, but got %v", kind)
+	}
+	if rows := lookup.Tag("pdsql.rows"); rows != 1 {
+		t.Errorf("Expected 1 row for www.trace.example, but got %v", rows)
+	}
+	if d := cname.Tag("pdsql.domain"); d != "trace.example" {
+		t.Errorf("Expected domain trace.example, but got %v", d)
+	}
+	if w := cname.Tag("pdsql.wildcard"); w != true {
+		t.Errorf("Expected the CNAME target to be answered by the wildcard, but got %v", w)
+	}
+}
@@ -0,0 +1,29 @@
+package pdsql
+
+import (
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+)
+
+// Transfer implements the transfer.Transferer interface, it streams the enabled records of the domain.
+func (pdb PowerDNSGenericSQLBackend) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	soa, rrs, err := LoadZone(pdb.DB, zone)
+	if err == ErrZoneNotFound {
+		return nil, transfer.ErrNotAuthoritative
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan []dns.RR, 2)
+	go func() {
+		defer close(ch)
+		if serial != 0 && serial >= soa.Serial {
+			ch <- []dns.RR{soa}
+			return
+		}
+		ch <- append([]dns.RR{soa}, rrs...)
+		ch <- []dns.RR{soa}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,73 @@
+package pdsql_test
+
+import (
+	"testing"
+
+	pdsql "github.com/wenerme/coredns-pdsql"
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"gorm.io/gorm"
+)
+
+func TestTransfer(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pdsql.PowerDNSGenericSQLBackend{DB: db}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	domain := &pdnsmodel.Domain{Name: "example.org", Type: "NATIVE"}
+	if err := p.DB.Create(domain).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []pdnsmodel.Record{
+		{Name: "example.org", DomainId: domain.ID, Type: "SOA", Content: "ns1.example.org. hostmaster.example.org. 10 3600 600 86400 300", Ttl: 3600},
+		{Name: "example.org", DomainId: domain.ID, Type: "NS", Content: "ns1.example.org", Ttl: 3600},
+		{Name: "www.example.org", DomainId: domain.ID, Type: "A", Content: "192.168.1.1", Ttl: 3600},
+		{Name: "lua.example.org", DomainId: domain.ID, Type: "LUA", Content: `A "pickrandom({'192.168.1.3'})"`, Ttl: 60},
+		{Name: "off.example.org", DomainId: domain.ID, Type: "A", Content: "192.168.1.2", Ttl: 3600, Disabled: true},
+	} {
+		if err := p.DB.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := p.Transfer("example.net.", 0); err != transfer.ErrNotAuthoritative {
+		t.Fatalf("Expected ErrNotAuthoritative, but got %v", err)
+	}
+
+	ch, err := p.Transfer("example.org.", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rrs []dns.RR
+	for batch := range ch {
+		rrs = append(rrs, batch...)
+	}
+	if len(rrs) != 5 {
+		t.Fatalf("Expected SOA, NS, LUA, A, SOA, but got %v", rrs)
+	}
+	if rrs[0].Header().Rrtype != dns.TypeSOA || rrs[4].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("Expected transfer to start and end with SOA, but got %v", rrs)
+	}
+	if lua := pdsql.FromRR(rrs[2]); lua.Type != "LUA" || lua.Content != `A "pickrandom({'192.168.1.3'})"` {
+		t.Errorf("Expected the LUA record transferred as TYPE65402, but got %v", rrs[2])
+	}
+
+	ch, err = p.Transfer("example.org.", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrs = nil
+	for batch := range ch {
+		rrs = append(rrs, batch...)
+	}
+	if len(rrs) != 1 {
+		t.Errorf("Expected only SOA for an up to date serial, but got %v", rrs)
+	}
+}
@@ -0,0 +1,315 @@
+package pdsql
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/miekg/dns"
+	"gorm.io/gorm"
+)
+
+// ImportMode controls how imported records are combined with the records already in the database.
+type ImportMode string
+
+const (
+	// ImportMerge replaces the rrsets present in the zone file and keeps the others.
+	ImportMerge ImportMode = "merge"
+	// ImportReplace deletes every record of the domain before importing.
+	ImportReplace ImportMode = "replace"
+)
+
+// ImportOptions configures ImportZone.
+type ImportOptions struct {
+	// Origin of the zone file, defaults to the owner of the SOA record.
+	Origin string
+	// Kind of a newly created domain, defaults to NATIVE.
+	Kind string
+	Mode ImportMode
+	// DryRun rolls the transaction back after the import.
+	DryRun bool
+}
+
+// ImportResult describes the changes made by ImportZone.
+type ImportResult struct {
+	Domain  pdnsmodel.Domain
+	Created bool
+	Added   int
+	Deleted int
+}
+
+var errDryRun = errors.New("dry run")
+
+// ErrZoneNotFound is returned when a domain does not exist or has no SOA record at its apex.
+var ErrZoneNotFound = errors.New("zone not found")
+
+// ImportZone parses an RFC 1035 master file and stores it as a PowerDNS domain with its records,
+// including the empty non-terminal rows, in a single transaction.
+func ImportZone(db *gorm.DB, r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	rrs, origin, err := parseZone(r, opts.Origin)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Mode == "" {
+		opts.Mode = ImportMerge
+	}
+	if opts.Mode != ImportMerge && opts.Mode != ImportReplace {
+		return nil, fmt.Errorf("unknown import mode %q", opts.Mode)
+	}
+	if opts.Kind == "" {
+		opts.Kind = "NATIVE"
+	}
+
+	now := int(time.Now().Unix())
+	var records []*pdnsmodel.Record
+	rrsets := map[[2]string]bool{}
+	names := map[string]bool{}
+	for _, rr := range rrs {
+		rec := FromRR(rr)
+		rec.ChangeDate = now
+		records = append(records, rec)
+		rrsets[[2]string{rec.Name, rec.Type}] = true
+		names[rec.Name] = true
+	}
+	apex := normalizeName(origin)
+	for _, ent := range emptyNonTerminals(names, apex) {
+		records = append(records, &pdnsmodel.Record{Name: ent, ChangeDate: now})
+	}
+
+	result := &ImportResult{}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var domains []pdnsmodel.Domain
+		if err := tx.Where("name = ?", apex).Limit(1).Find(&domains).Error; err != nil {
+			return err
+		}
+		if len(domains) == 0 {
+			result.Domain = pdnsmodel.Domain{Name: apex, Type: strings.ToUpper(opts.Kind)}
+			if err := tx.Create(&result.Domain).Error; err != nil {
+				return err
+			}
+			result.Created = true
+		} else {
+			result.Domain = domains[0]
+		}
+		id := result.Domain.ID
+
+		switch opts.Mode {
+		case ImportReplace:
+			res := tx.Where("domain_id = ?", id).Delete(&pdnsmodel.Record{})
+			if res.Error != nil {
+				return res.Error
+			}
+			result.Deleted += int(res.RowsAffected)
+		case ImportMerge:
+			for key := range rrsets {
+				res := tx.Where("domain_id = ? AND name = ? AND type = ?", id, key[0], key[1]).Delete(&pdnsmodel.Record{})
+				if res.Error != nil {
+					return res.Error
+				}
+				result.Deleted += int(res.RowsAffected)
+			}
+		}
+
+		for _, rec := range records {
+			rec.DomainId = id
+			if rec.Type == "" && opts.Mode == ImportMerge {
+				var count int64
+				if err := tx.Model(&pdnsmodel.Record{}).Where("domain_id = ? AND name = ?", id, rec.Name).Count(&count).Error; err != nil {
+					return err
+				}
+				if count != 0 {
+					continue
+				}
+			}
+			if rec.Type == "" {
+				// PowerDNS marks empty non-terminals with a NULL type
+				if err := tx.Model(&pdnsmodel.Record{}).Create(map[string]interface{}{
+					"domain_id": id, "name": rec.Name, "type": nil, "content": "", "ttl": 0, "prio": 0,
+					"change_date": rec.ChangeDate, "disabled": false,
+				}).Error; err != nil {
+					return err
+				}
+				result.Added++
+				continue
+			}
+			if err := tx.Create(rec).Error; err != nil {
+				return err
+			}
+			result.Added++
+		}
+
+		if opts.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && err != errDryRun {
+		return nil, err
+	}
+	return result, nil
+}
+
+// parseZone reads all records of a zone file, they must be inside origin.
+func parseZone(r io.Reader, origin string) ([]dns.RR, string, error) {
+	if origin != "" {
+		origin = dns.Fqdn(strings.ToLower(origin))
+	}
+	zp := dns.NewZoneParser(r, origin, "")
+	zp.SetIncludeAllowed(false)
+
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		if origin == "" && rr.Header().Rrtype == dns.TypeSOA {
+			origin = rr.Header().Name
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, "", err
+	}
+	if origin == "" {
+		return nil, "", errors.New("zone has no SOA record and no origin was given")
+	}
+
+	soa := false
+	for _, rr := range rrs {
+		if !dns.IsSubDomain(origin, rr.Header().Name) {
+			return nil, "", fmt.Errorf("record %s is out of zone %s", rr.Header().Name, origin)
+		}
+		if rr.Header().Rrtype == dns.TypeSOA {
+			if rr.Header().Name != origin {
+				return nil, "", fmt.Errorf("SOA record %s is not at the zone apex %s", rr.Header().Name, origin)
+			}
+			soa = true
+		}
+	}
+	if !soa {
+		return nil, "", fmt.Errorf("zone %s has no SOA record", origin)
+	}
+	return rrs, origin, nil
+}
+
+// emptyNonTerminals returns the names between the apex and the owner names which own no records.
+func emptyNonTerminals(names map[string]bool, apex string) []string {
+	var ents []string
+	seen := map[string]bool{}
+	for name := range names {
+		labels := dns.SplitDomainName(name)
+		for i := 1; i < len(labels); i++ {
+			parent := strings.Join(labels[i:], ".")
+			if parent == apex || !strings.HasSuffix(parent, "."+apex) {
+				break
+			}
+			if !names[parent] && !seen[parent] {
+				seen[parent] = true
+				ents = append(ents, parent)
+			}
+		}
+	}
+	return ents
+}
+
+// LoadZone reads the enabled records of a domain converted the same way ServeDNS does, skipping
+// malformed ones, the apex SOA is returned separately and the other records are sorted in canonical order.
+// Types ServeDNS does not answer are parsed from their content, a row failing that fails the whole load.
+func LoadZone(db *gorm.DB, zone string) (*dns.SOA, []dns.RR, error) {
+	name := normalizeName(zone)
+
+	var domains []pdnsmodel.Domain
+	if err := db.Where("name = ?", name).Limit(1).Find(&domains).Error; err != nil {
+		return nil, nil, err
+	}
+	if len(domains) == 0 {
+		return nil, nil, ErrZoneNotFound
+	}
+
+	var records []*pdnsmodel.Record
+	if err := db.Where("domain_id = ?", domains[0].ID).
+		Where("disabled = ?", false).
+		Order("name, type, id").
+		Find(&records).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var soa *dns.SOA
+	var rrs []dns.RR
+	for _, v := range records {
+		rr, err := ToRR(v, dns.ClassINET)
+		if errors.Is(err, ErrMalformedRecord) {
+			// reported by CheckZone
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if rr == nil {
+			if v.Type == "" {
+				// empty non-terminal
+				continue
+			}
+			// types pdsql does not answer are kept as they were imported
+			rr, err = dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(v.Name), v.Ttl, v.Type, v.Content))
+			if err != nil || rr == nil {
+				return nil, nil, fmt.Errorf("record %d %s %s can not be exported: %v", v.ID, v.Name, v.Type, err)
+			}
+		}
+		if s, ok := rr.(*dns.SOA); ok {
+			if soa == nil && v.Name == name {
+				soa = s
+			}
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	if soa == nil {
+		return nil, nil, ErrZoneNotFound
+	}
+
+	sort.SliceStable(rrs, func(i, j int) bool {
+		hi, hj := rrs[i].Header(), rrs[j].Header()
+		if c := compareNames(hi.Name, hj.Name); c != 0 {
+			return c < 0
+		}
+		if hi.Rrtype != hj.Rrtype {
+			return hi.Rrtype < hj.Rrtype
+		}
+		return rrs[i].String() < rrs[j].String()
+	})
+	return soa, rrs, nil
+}
+
+// ExportZone writes a domain as an RFC 1035 master file, the SOA record first
+// followed by the other records in canonical order.
+func ExportZone(db *gorm.DB, zone string, w io.Writer) error {
+	soa, rrs, err := LoadZone(db, zone)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$ORIGIN %s\n", dns.Fqdn(strings.ToLower(zone)))
+	fmt.Fprintln(bw, soa.String())
+	for _, rr := range rrs {
+		fmt.Fprintln(bw, rr.String())
+	}
+	return bw.Flush()
+}
+
+// compareNames orders domain names canonically, RFC 4034 section 6.1.
+func compareNames(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
@@ -0,0 +1,272 @@
+package pdsql_test
+
+import (
+	"strings"
+	"testing"
+
+	pdsql "github.com/wenerme/coredns-pdsql"
+	"github.com/wenerme/coredns-pdsql/pdnsmodel"
+
+	"github.com/coredns/coredns/plugin/file"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/glebarez/sqlite"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"gorm.io/gorm"
+)
+
+const exampleZone = `$ORIGIN example.org.
+$TTL 3600
+@       IN SOA  ns1.example.org. hostmaster.example.org. 2024050100 10800 3600 604800 3600
+        IN NS   ns1
+        IN MX   10 mail
+ns1     IN A    192.168.1.1
+mail    IN A    192.168.1.2
+www     IN CNAME mail
+*       IN A    192.168.1.3
+_xmpp._tcp IN SRV 10 20 5269 mail
+host.deep.sub IN TXT "deep"
+`
+
+func newZoneBackend(t *testing.T) pdsql.PowerDNSGenericSQLBackend {
+	db, err := gorm.Open(sqlite.Open(":memory:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pdsql.PowerDNSGenericSQLBackend{DB: db}
+	if err := p.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestImportZone(t *testing.T) {
+	p := newZoneBackend(t)
+
+	res, err := pdsql.ImportZone(p.DB, strings.NewReader(exampleZone), pdsql.ImportOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Created || res.Added != 12 {
+		t.Errorf("Expected new zone with 12 records, but got %+v", res)
+	}
+	var count int64
+	p.DB.Model(&pdnsmodel.Record{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("Expected dry run to roll back, but got %d records", count)
+	}
+
+	if _, err := pdsql.ImportZone(p.DB, strings.NewReader(exampleZone), pdsql.ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var mx, srv pdnsmodel.Record
+	p.DB.Where("type = ?", "MX").First(&mx)
+	if mx.Prio != 10 || mx.Content != "mail.example.org" {
+		t.Errorf("Expected MX split into prio 10 and mail.example.org, but got %d %q", mx.Prio, mx.Content)
+	}
+	p.DB.Where("type = ?", "SRV").First(&srv)
+	if srv.Prio != 10 || srv.Content != "20 5269 mail.example.org" {
+		t.Errorf("Expected SRV split into prio 10 and '20 5269 mail.example.org', but got %d %q", srv.Prio, srv.Content)
+	}
+	var txt pdnsmodel.Record
+	p.DB.Where("type = ?", "TXT").First(&txt)
+	if txt.Content != `"deep"` {
+		t.Errorf("Expected quoted TXT content, but got %q", txt.Content)
+	}
+	// empty non-terminals have a NULL type like in PowerDNS
+	var ents []string
+	p.DB.Model(&pdnsmodel.Record{}).Where("type IS NULL").Order("name").Pluck("name", &ents)
+	if strings.Join(ents, ",") != "_tcp.example.org,deep.sub.example.org,sub.example.org" {
+		t.Errorf("Expected empty non-terminal rows, but got %v", ents)
+	}
+
+	for qname, expected := range map[string]int{
+		"example.org. MX":             1,
+		"www.example.org. A":          2,
+		"_xmpp._tcp.example.org. SRV": 1,
+		"other.example.org. A":        1,
+		"sub.example.org. A":          0,
+	} {
+		parts := strings.Fields(qname)
+		req := new(dns.Msg)
+		req.SetQuestion(parts[0], dns.StringToType[parts[1]])
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		p.ServeDNS(context.TODO(), rec, req)
+		answers := 0
+		if rec.Msg != nil {
+			answers = len(rec.Msg.Answer)
+		}
+		if answers != expected {
+			t.Errorf("Query %s: Expected %d answers, but got %d", qname, expected, answers)
+		}
+	}
+
+	update := "$ORIGIN example.org.\n@ 3600 IN SOA ns1 hostmaster 2024050101 10800 3600 604800 3600\nmail 60 IN A 192.168.1.9\n"
+	res, err = pdsql.ImportZone(p.DB, strings.NewReader(update), pdsql.ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Created || res.Added != 2 || res.Deleted != 2 {
+		t.Errorf("Expected merge to replace 2 rrsets, but got %+v", res)
+	}
+	p.DB.Model(&pdnsmodel.Record{}).Count(&count)
+	if count != 12 {
+		t.Errorf("Expected merge to keep the other records, but got %d records", count)
+	}
+
+	res, err = pdsql.ImportZone(p.DB, strings.NewReader(update), pdsql.ImportOptions{Mode: pdsql.ImportReplace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.DB.Model(&pdnsmodel.Record{}).Count(&count)
+	if count != 2 {
+		t.Errorf("Expected replace to drop the other records, but got %d records", count)
+	}
+}
+
+func TestImportZoneErrors(t *testing.T) {
+	p := newZoneBackend(t)
+	for _, zone := range []string{
+		"www.example.org. 3600 IN A 192.168.1.1\n",
+		"$ORIGIN example.org.\n@ 3600 IN SOA ns1 hostmaster 1 2 3 4 5\nwww.example.net. 3600 IN A 192.168.1.1\n",
+		"$ORIGIN example.org.\n@ 3600 IN SOA ns1 hostmaster 1 2 3 4 5\nwww 3600 IN A invalid\n",
+	} {
+		if _, err := pdsql.ImportZone(p.DB, strings.NewReader(zone), pdsql.ImportOptions{}); err == nil {
+			t.Errorf("Expected error for zone %q", zone)
+		}
+	}
+}
+
+func TestExportZone(t *testing.T) {
+	p := newZoneBackend(t)
+	if _, err := pdsql.ImportZone(p.DB, strings.NewReader(exampleZone), pdsql.ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := pdsql.ExportZone(p.DB, "example.org.", &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `$ORIGIN example.org.
+example.org.	3600	IN	SOA	ns1.example.org. hostmaster.example.org. 2024050100 10800 3600 604800 3600
+example.org.	3600	IN	NS	ns1.example.org.
+example.org.	3600	IN	MX	10 mail.example.org.
+*.example.org.	3600	IN	A	192.168.1.3
+_xmpp._tcp.example.org.	3600	IN	SRV	10 20 5269 mail.example.org.
+mail.example.org.	3600	IN	A	192.168.1.2
+ns1.example.org.	3600	IN	A	192.168.1.1
+host.deep.sub.example.org.	3600	IN	TXT	"deep"
+www.example.org.	3600	IN	CNAME	mail.example.org.
+`
+	if out.String() != expected {
+		t.Errorf("Expected export\n%s\nbut got\n%s", expected, out.String())
+	}
+
+	if _, err := file.Parse(strings.NewReader(out.String()), "example.org.", "export", 0); err != nil {
+		t.Errorf("Expected export to load into the file plugin, but got %v", err)
+	}
+
+	// the export round-trips through the import
+	q := newZoneBackend(t)
+	if _, err := pdsql.ImportZone(q.DB, strings.NewReader(out.String()), pdsql.ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var again strings.Builder
+	if err := pdsql.ExportZone(q.DB, "example.org.", &again); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != out.String() {
+		t.Errorf("Expected export to round-trip, but got\n%s", again.String())
+	}
+
+	// types pdsql does not answer are exported as imported
+	r := newZoneBackend(t)
+	zone := exampleZone + `@ IN CAA 0 issue "letsencrypt.org"
+_443._tcp.www IN TLSA 3 1 1 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+`
+	if _, err := pdsql.ImportZone(r.DB, strings.NewReader(zone), pdsql.ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var other strings.Builder
+	if err := pdsql.ExportZone(r.DB, "example.org.", &other); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"example.org.\t3600\tIN\tCAA\t0 issue \"letsencrypt.org\"\n",
+		"_443._tcp.www.example.org.\t3600\tIN\tTLSA\t3 1 1 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef\n",
+	} {
+		if !strings.Contains(other.String(), line) {
+			t.Errorf("Expected export to contain %q, but got\n%s", line, other.String())
+		}
+	}
+	var domain pdnsmodel.Domain
+	r.DB.Where("name = ?", "example.org").First(&domain)
+	r.DB.Create(&pdnsmodel.Record{DomainId: domain.ID, Name: "lua.example.org", Type: "LUA", Content: `A "ifportup(443, {'192.0.2.1'})"`, Ttl: 60})
+	r.DB.Create(&pdnsmodel.Record{DomainId: domain.ID, Name: "bad.example.org", Type: "LUA", Content: `A "192.0.2.1"`, Ttl: 60})
+	other.Reset()
+	if err := pdsql.ExportZone(r.DB, "example.org.", &other); err != nil {
+		t.Fatal(err)
+	}
+	// LUA records are written as the TYPE65402 record PowerDNS transfers, the malformed one is left out
+	lua := "lua.example.org.\t60\tCLASS1\tTYPE65402\t\\# 30 00016966706f72747570283434332c207b273139322e302e322e31277d29\n"
+	if !strings.Contains(other.String(), lua) || strings.Contains(other.String(), "bad.example.org.") {
+		t.Errorf("Expected export to contain %q only, but got\n%s", lua, other.String())
+	}
+	s := newZoneBackend(t)
+	if _, err := pdsql.ImportZone(s.DB, strings.NewReader(other.String()), pdsql.ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var imported pdnsmodel.Record
+	s.DB.Where("name = ?", "lua.example.org").First(&imported)
+	if imported.Type != "LUA" || imported.Content != `A "ifportup(443, {'192.0.2.1'})"` {
+		t.Errorf("Expected the LUA record to round-trip, but got %s %s", imported.Type, imported.Content)
+	}
+
+	r.DB.Create(&pdnsmodel.Record{DomainId: domain.ID, Name: "unknown.example.org", Type: "UNKNOWN", Content: "data", Ttl: 60})
+	other.Reset()
+	if err := pdsql.ExportZone(r.DB, "example.org.", &other); err == nil || other.Len() != 0 {
+		t.Errorf("Expected the export to fail without output, but got %v\n%s", err, other.String())
+	}
+
+	if err := pdsql.ExportZone(p.DB, "example.net.", &out); err != pdsql.ErrZoneNotFound {
+		t.Errorf("Expected ErrZoneNotFound, but got %v", err)
+	}
+}
+
+func TestTXTStrings(t *testing.T) {
+	key := strings.Repeat("A", 300)
+	dkim := test.TXT(`sel._domainkey.example.org. 3600 IN TXT "v=DKIM1; k=rsa; p=` + key[:200] + `" "` + key[200:] + `"`)
+
+	tests := []struct {
+		rr       dns.RR
+		expected []string
+	}{
+		{test.TXT(`example.org. 3600 IN TXT "hello world"`), []string{"hello world"}},
+		{dkim, dkim.Txt},
+		{test.TXT(`example.org. 3600 IN TXT "a b" "c"`), []string{"a b", "c"}},
+	}
+	for _, tc := range tests {
+		row := pdsql.FromRR(tc.rr)
+		rr, err := pdsql.ToRR(row, dns.ClassINET)
+		if err != nil {
+			t.Fatalf("Expected no error for content %s, but got %v", row.Content, err)
+		}
+		if got := rr.(*dns.TXT).Txt; strings.Join(got, "|") != strings.Join(tc.expected, "|") {
+			t.Errorf("Expected strings %q, but got %q from content %s", tc.expected, got, row.Content)
+		}
+		if _, err := dns.PackRR(rr, make([]byte, 4096), 0, nil, false); err != nil {
+			t.Errorf("Expected %v to pack, but got %v", rr, err)
+		}
+	}
+
+	// long unquoted content is split into strings of 255 bytes
+	rr, err := pdsql.ToRR(&pdnsmodel.Record{Name: "example.org", Type: "TXT", Content: key, Ttl: 3600}, dns.ClassINET)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txt := rr.(*dns.TXT).Txt; len(txt) != 2 || len(txt[0]) != 255 || txt[0]+txt[1] != key {
+		t.Errorf("Expected the content split at 255 bytes, but got %q", txt)
+	}
+}